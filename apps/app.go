@@ -2,15 +2,60 @@ package apps
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/CiscoCloud/marathon-consul/utils"
 	"github.com/hashicorp/consul/api"
 )
 
+var ErrBadUnreachableStrategy = errors.New(`unreachableStrategy must be an object or "disabled"`)
+
 type PortMapping struct {
-	ContainerPort int    `json:"containerPort"`
-	HostPort      int    `json:"hostPort"`
-	ServicePort   int    `json:"servicePort"`
-	Protocol      string `json:"protocol"`
+	ContainerPort int               `json:"containerPort"`
+	HostPort      int               `json:"hostPort"`
+	ServicePort   int               `json:"servicePort"`
+	Protocol      string            `json:"protocol"`
+	Name          string            `json:"name,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+
+	// hostless is set for mappings decoded without a hostPort, which on a
+	// USER network don't get one at all. A hostPort of 0 asks for any.
+	hostless bool
+}
+
+type portMapping PortMapping
+
+func (m *PortMapping) UnmarshalJSON(data []byte) error {
+	decoded := struct {
+		*portMapping
+		HostPort *int `json:"hostPort"`
+	}{portMapping: (*portMapping)(m)}
+
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	m.hostless = decoded.HostPort == nil
+	if decoded.HostPort != nil {
+		m.HostPort = *decoded.HostPort
+	}
+	return nil
+}
+
+func (m PortMapping) MarshalJSON() ([]byte, error) {
+	if !m.hostless {
+		return json.Marshal(portMapping(m))
+	}
+
+	return json.Marshal(struct {
+		portMapping
+		HostPort *int `json:"hostPort,omitempty"`
+	}{portMapping: portMapping(m)})
+}
+
+// HasHostPort tells whether tasks get a host port for the mapping on network
+func (m PortMapping) HasHostPort(network string) bool {
+	return network != NetworkUser || !m.hostless
 }
 
 type Parameter struct {
@@ -18,6 +63,14 @@ type Parameter struct {
 	Value string `json:"value"`
 }
 
+// Docker networking modes. In USER mode, tasks join the network named by the
+// app's IPAddress, and port mappings are optional.
+const (
+	NetworkBridge = "BRIDGE"
+	NetworkHost   = "HOST"
+	NetworkUser   = "USER"
+)
+
 type Docker struct {
 	Image          string        `json:"image"`
 	Parameters     []Parameter   `json:"parameters"`
@@ -39,45 +92,276 @@ type Container struct {
 	Volumes []Volume `json:"volumes"`
 }
 
+// Command is what a COMMAND health check runs
+type Command struct {
+	Value string `json:"value"`
+}
+
+// HealthCheck checks either a port, given by PortIndex or Port, or a Command.
+// Path and PortIndex are always written, as they always have been, even for
+// checks that have neither.
 type HealthCheck struct {
-	Path                   string `json:"path"`
-	PortIndex              int    `json:"portIndex"`
-	Protocol               string `json:"protocol"`
-	GracePeriodSeconds     int    `json:"gracePeriodSeconds"`
-	IntervalSeconds        int    `json:"intervalSeconds"`
-	TimeoutSeconds         int    `json:"timeoutSeconds"`
-	MaxConsecutiveFailures int    `json:"maxConsecutiveFailures"`
+	Path                   string   `json:"path"`
+	PortIndex              int      `json:"portIndex"`
+	Port                   int      `json:"port,omitempty"`
+	Command                *Command `json:"command,omitempty"`
+	Protocol               string   `json:"protocol"`
+	GracePeriodSeconds     int      `json:"gracePeriodSeconds"`
+	IntervalSeconds        int      `json:"intervalSeconds"`
+	TimeoutSeconds         int      `json:"timeoutSeconds"`
+	MaxConsecutiveFailures int      `json:"maxConsecutiveFailures"`
+	DelaySeconds           int      `json:"delaySeconds,omitempty"`
+	IgnoreHTTP1xx          bool     `json:"ignoreHttp1xx,omitempty"`
 }
 
+// ReadinessCheck holds back a deployment until new tasks are ready
+type ReadinessCheck struct {
+	Name                    string `json:"name"`
+	Protocol                string `json:"protocol"`
+	Path                    string `json:"path"`
+	PortName                string `json:"portName"`
+	IntervalSeconds         int    `json:"intervalSeconds"`
+	TimeoutSeconds          int    `json:"timeoutSeconds"`
+	HTTPStatusCodesForReady []int  `json:"httpStatusCodesForReady"`
+	PreserveLastResponse    bool   `json:"preserveLastResponse"`
+}
+
+// Fetch is a URI the Mesos fetcher downloads into the sandbox
+type Fetch struct {
+	URI        string `json:"uri"`
+	Executable bool   `json:"executable"`
+	Extract    bool   `json:"extract"`
+	Cache      bool   `json:"cache"`
+	DestPath   string `json:"destPath,omitempty"`
+}
+
+// Residency keeps the tasks of apps with persistent volumes on their agents
+type Residency struct {
+	RelaunchEscalationTimeoutSeconds int    `json:"relaunchEscalationTimeoutSeconds"`
+	TaskLostBehavior                 string `json:"taskLostBehavior"`
+}
+
+// EnvSecret sets an environment variable to one of the app's Secrets. Marathon
+// sends these in env, next to plain values.
+type EnvSecret struct {
+	Secret string `json:"secret"`
+}
+
+// Secret refers to a secret in the secret store
+type Secret struct {
+	Source string `json:"source"`
+}
+
+// VersionInfo tells when the app was last scaled and last changed otherwise
+type VersionInfo struct {
+	LastScalingAt      string `json:"lastScalingAt"`
+	LastConfigChangeAt string `json:"lastConfigChangeAt"`
+}
+
+// PortDefinition is a port requested for an app on the host network
+type PortDefinition struct {
+	Port     int               `json:"port"`
+	Protocol string            `json:"protocol"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type DiscoveryPort struct {
+	Number   int    `json:"number"`
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+}
+
+type Discovery struct {
+	Ports []DiscoveryPort `json:"ports"`
+}
+
+// IPAddress asks for an IP address per task
+type IPAddress struct {
+	Groups      []string          `json:"groups"`
+	Labels      map[string]string `json:"labels"`
+	Discovery   *Discovery        `json:"discovery"`
+	NetworkName string            `json:"networkName"`
+}
+
+// UpgradeStrategy is all there is to Marathon's upgradeStrategy: it has no
+// other fields to keep
 type UpgradeStrategy struct {
 	MinimumHealthCapacity float64 `json:"minimumHealthCapacity"`
 	MaximumOverCapacity   float64 `json:"maximumOverCapacity"`
 }
 
+// UnreachableStrategy tells how long an unreachable task is kept before it is
+// replaced, then expunged. Marathon sends "disabled" when it never is.
+type UnreachableStrategy struct {
+	Disabled             bool `json:"-"`
+	InactiveAfterSeconds int  `json:"inactiveAfterSeconds"`
+	ExpungeAfterSeconds  int  `json:"expungeAfterSeconds"`
+}
+
+const unreachableDisabled = "disabled"
+
+type unreachableStrategy UnreachableStrategy
+
+func (s UnreachableStrategy) MarshalJSON() ([]byte, error) {
+	if s.Disabled {
+		return json.Marshal(unreachableDisabled)
+	}
+	return json.Marshal(unreachableStrategy(s))
+}
+
+func (s *UnreachableStrategy) UnmarshalJSON(data []byte) error {
+	var disabled string
+	if json.Unmarshal(data, &disabled) == nil {
+		if disabled != unreachableDisabled {
+			return ErrBadUnreachableStrategy
+		}
+		*s = UnreachableStrategy{Disabled: true}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*unreachableStrategy)(s))
+}
+
 type App struct {
-	Args            []string          `json:"args"`
-	BackoffFactor   float64           `json:"backoffFactor"`
-	BackoffSeconds  int               `json:"backoffSeconds"`
-	Cmd             string            `json:"cmd"`
-	Constraints     [][]string        `json:"constraints"`
-	Container       *Container        `json:"container"`
-	CPUs            float64           `json:"cpus"`
-	Dependencies    []string          `json:"dependencies"`
-	Disk            float64           `json:"disk"`
-	Env             map[string]string `json:"env"`
-	Executor        string            `json:"executor"`
-	Labels          map[string]string `json:"labels"`
-	HealthChecks    []HealthCheck     `json:"healthChecks"`
-	ID              string            `json:"id"`
-	Instances       int               `json:"instances"`
-	Mem             float64           `json:"mem"`
-	Ports           []int             `json:"ports"`
-	RequirePorts    bool              `json:"requirePorts"`
-	StoreUrls       []string          `json:"storeUrls"`
-	UpgradeStrategy UpgradeStrategy   `json:"upgradeStrategy"`
-	Uris            []string          `json:"uris"`
-	User            string            `json:"user"`
-	Version         string            `json:"version"`
+	Args                       []string             `json:"args"`
+	BackoffFactor              float64              `json:"backoffFactor"`
+	BackoffSeconds             int                  `json:"backoffSeconds"`
+	Cmd                        string               `json:"cmd"`
+	Constraints                [][]string           `json:"constraints"`
+	Container                  *Container           `json:"container"`
+	CPUs                       float64              `json:"cpus"`
+	Dependencies               []string             `json:"dependencies"`
+	Disk                       float64              `json:"disk"`
+	Env                        map[string]string    `json:"env"`
+	EnvSecrets                 map[string]EnvSecret `json:"-"`
+	Executor                   string               `json:"executor"`
+	Fetch                      []Fetch              `json:"fetch"`
+	GPUs                       float64              `json:"gpus"`
+	Labels                     map[string]string    `json:"labels"`
+	HealthChecks               []HealthCheck        `json:"healthChecks"`
+	ID                         string               `json:"id"`
+	IPAddress                  *IPAddress           `json:"ipAddress"`
+	Instances                  int                  `json:"instances"`
+	KillSelection              string               `json:"killSelection"`
+	MaxLaunchDelaySeconds      int                  `json:"maxLaunchDelaySeconds"`
+	Mem                        float64              `json:"mem"`
+	PortDefinitions            []PortDefinition     `json:"portDefinitions"`
+	Ports                      []int                `json:"ports"`
+	ReadinessChecks            []ReadinessCheck     `json:"readinessChecks"`
+	RequirePorts               bool                 `json:"requirePorts"`
+	Residency                  *Residency           `json:"residency,omitempty"`
+	Secrets                    map[string]Secret    `json:"secrets"`
+	StoreUrls                  []string             `json:"storeUrls"`
+	TaskKillGracePeriodSeconds int                  `json:"taskKillGracePeriodSeconds,omitempty"`
+	UnreachableStrategy        *UnreachableStrategy `json:"unreachableStrategy"`
+	UpgradeStrategy            UpgradeStrategy      `json:"upgradeStrategy"`
+	Uris                       []string             `json:"uris"`
+	User                       string               `json:"user"`
+	Version                    string               `json:"version"`
+	VersionInfo                *VersionInfo         `json:"versionInfo,omitempty"`
+
+	// unknown holds the top-level fields Marathon sent that App doesn't know
+	// about, so they're stored all the same
+	unknown map[string]json.RawMessage
+	// nested holds what Marathon sent inside the known fields that App
+	// doesn't know about, like new container.docker keys, see extraFields
+	nested interface{}
+	// raw is the app as Marathon sent it, for the Raw and Canonical encodings
+	raw json.RawMessage
+}
+
+// NamedPorts describes the ports of the app's tasks, in order: the discovery
+// ports with IP-per-task, the port mappings of Docker containers on a bridge
+// or user network, the port definitions otherwise
+func (app *App) NamedPorts() []PortDefinition {
+	if app.IPAddress != nil && app.IPAddress.Discovery != nil && len(app.IPAddress.Discovery.Ports) > 0 {
+		ports := make([]PortDefinition, len(app.IPAddress.Discovery.Ports))
+		for i, port := range app.IPAddress.Discovery.Ports {
+			ports[i] = PortDefinition{Port: port.Number, Protocol: port.Protocol, Name: port.Name}
+		}
+		return ports
+	}
+
+	if docker := app.docker(); docker != nil && (docker.Network == NetworkBridge || docker.Network == NetworkUser) && len(docker.PortMappings) > 0 {
+		ports := make([]PortDefinition, len(docker.PortMappings))
+		for i, mapping := range docker.PortMappings {
+			ports[i] = PortDefinition{
+				Port:     mapping.ContainerPort,
+				Protocol: mapping.Protocol,
+				Name:     mapping.Name,
+				Labels:   mapping.Labels,
+			}
+		}
+		return ports
+	}
+
+	return app.PortDefinitions
+}
+
+// TaskPort is where a task serves one of its app's ports
+type TaskPort struct {
+	// HostIndex is the index of the port among the task's Ports, or -1 if
+	// it isn't given a host port
+	HostIndex int
+	// ContainerPort is the port on the task's own IP address, with
+	// IP-per-task or on a USER network, or 0
+	ContainerPort int
+}
+
+// TaskPorts tells where tasks serve each of NamedPorts, in the same order.
+// Tasks only get host ports for port definitions and for port mappings that
+// have one, so indices into NamedPorts don't always line up with tasks' Ports.
+func (app *App) TaskPorts() []TaskPort {
+	if app.IPAddress != nil && app.IPAddress.Discovery != nil && len(app.IPAddress.Discovery.Ports) > 0 {
+		ports := make([]TaskPort, len(app.IPAddress.Discovery.Ports))
+		for i, port := range app.IPAddress.Discovery.Ports {
+			ports[i] = TaskPort{HostIndex: -1, ContainerPort: port.Number}
+		}
+		return ports
+	}
+
+	if docker := app.docker(); docker != nil && (docker.Network == NetworkBridge || docker.Network == NetworkUser) && len(docker.PortMappings) > 0 {
+		ports := make([]TaskPort, len(docker.PortMappings))
+		host := 0
+		for i, mapping := range docker.PortMappings {
+			ports[i] = TaskPort{HostIndex: -1}
+			if docker.Network == NetworkUser {
+				ports[i].ContainerPort = mapping.ContainerPort
+			}
+			if mapping.HasHostPort(docker.Network) {
+				ports[i].HostIndex = host
+				host++
+			}
+		}
+		return ports
+	}
+
+	ports := make([]TaskPort, len(app.PortDefinitions))
+	for i := range app.PortDefinitions {
+		ports[i] = TaskPort{HostIndex: i}
+	}
+	return ports
+}
+
+// HostPorts describes the ports tasks get on their host, in the same order
+// as their Ports: NamedPorts without the ones that aren't given a host port
+func (app *App) HostPorts() []PortDefinition {
+	named := app.NamedPorts()
+	ports := make([]PortDefinition, 0, len(named))
+	for i, served := range app.TaskPorts() {
+		if served.HostIndex >= 0 {
+			ports = append(ports, named[i])
+		}
+	}
+	return ports
+}
+
+func (app *App) docker() *Docker {
+	if app.Container == nil {
+		return nil
+	}
+	return app.Container.Docker
 }
 
 func (app *App) KV() *api.KVPair {
@@ -89,6 +373,26 @@ func (app *App) KV() *api.KVPair {
 	}
 }
 
+// EncodedKV is KV, with the app serialized in encoding
+func (app *App) EncodedKV(encoding Encoding) *api.KVPair {
+	return &api.KVPair{
+		Key:   app.Key(),
+		Value: app.Encode(encoding),
+	}
+}
+
 func (app *App) Key() string {
 	return utils.CleanID(app.ID)
 }
+
+// VersionsKey is where the app's earlier definitions are kept, by version
+func (app *App) VersionsKey() string {
+	return app.Key() + "/versions"
+}
+
+// VersionKV stores the app as the definition it had at its version
+func (app *App) VersionKV(encoding Encoding) *api.KVPair {
+	pair := app.EncodedKV(encoding)
+	pair.Key = app.VersionsKey() + "/" + app.Version
+	return pair
+}
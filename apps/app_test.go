@@ -19,7 +19,7 @@ var testApp = App{
 			Image:          "alpine",
 			Parameters:     []Parameter{Parameter{"hostname", "container.example.com"}},
 			Privileged:     true,
-			PortMappings:   []PortMapping{PortMapping{8080, 8080, 0, "tcp"}},
+			PortMappings:   []PortMapping{{ContainerPort: 8080, HostPort: 8080, ServicePort: 0, Protocol: "tcp"}},
 			Network:        "BRIDGED",
 			ForcePullImage: true,
 		},
@@ -71,3 +71,228 @@ func TestAppKV(t *testing.T) {
 	assert.Equal(t, kv.Key, testApp.Key())
 	assert.Equal(t, kv.Value, jsonified)
 }
+
+func TestAppNamedPorts(t *testing.T) {
+	t.Parallel()
+
+	app := &App{PortDefinitions: []PortDefinition{{Port: 10000, Protocol: "tcp", Name: "http"}}}
+	assert.Equal(t, app.PortDefinitions, app.NamedPorts())
+
+	// IP-per-task apps name their ports in the discovery info
+	app.IPAddress = &IPAddress{Discovery: &Discovery{Ports: []DiscoveryPort{{80, "web", "tcp"}}}}
+	assert.Equal(t, []PortDefinition{{Port: 80, Protocol: "tcp", Name: "web"}}, app.NamedPorts())
+}
+
+// an app as Marathon 1.4 lists it in /v2/apps?embed=apps.tasks, with a field
+// from some later version
+var marathonApp = []byte(`{
+    "id": "/product/web",
+    "cmd": "nginx -g 'daemon off;'",
+    "args": null,
+    "user": "nobody",
+    "env": {"LANG": "C", "SECRET_TOKEN": {"secret": "token"}},
+    "instances": 2,
+    "cpus": 0.5,
+    "mem": 128,
+    "disk": 0,
+    "gpus": 0,
+    "executor": "",
+    "constraints": [],
+    "uris": [],
+    "fetch": [{"uri": "https://example.com/config.tgz", "extract": true, "executable": false, "cache": false}],
+    "storeUrls": [],
+    "backoffSeconds": 1,
+    "backoffFactor": 1.15,
+    "maxLaunchDelaySeconds": 3600,
+    "container": {
+        "type": "DOCKER",
+        "volumes": [],
+        "docker": {
+            "image": "nginx",
+            "network": "USER",
+            "portMappings": [{"containerPort": 80, "hostPort": 0, "servicePort": 10000, "protocol": "tcp", "name": "http", "labels": {"VIP_0": "/web:80"}}],
+            "privileged": false,
+            "parameters": [],
+            "forcePullImage": false
+        }
+    },
+    "healthChecks": [
+        {"gracePeriodSeconds": 300, "intervalSeconds": 60, "timeoutSeconds": 20, "maxConsecutiveFailures": 3, "portIndex": 0, "path": "/", "protocol": "MESOS_HTTP", "delaySeconds": 15},
+        {"gracePeriodSeconds": 300, "intervalSeconds": 60, "timeoutSeconds": 20, "maxConsecutiveFailures": 3, "delaySeconds": 15, "command": {"value": "curl -f http://$HOST:$PORT0/"}, "protocol": "COMMAND"}
+    ],
+    "readinessChecks": [{"name": "readiness", "protocol": "HTTP", "path": "/ready", "portName": "http", "intervalSeconds": 30, "timeoutSeconds": 10, "httpStatusCodesForReady": [200], "preserveLastResponse": false}],
+    "dependencies": [],
+    "upgradeStrategy": {"minimumHealthCapacity": 1, "maximumOverCapacity": 1},
+    "labels": {},
+    "ipAddress": {"groups": [], "labels": {}, "discovery": {"ports": []}, "networkName": "dcos"},
+    "version": "2017-03-07T12:04:15.337Z",
+    "residency": {"relaunchEscalationTimeoutSeconds": 3600, "taskLostBehavior": "WAIT_FOREVER"},
+    "secrets": {"token": {"source": "/web/token"}},
+    "taskKillGracePeriodSeconds": 10,
+    "unreachableStrategy": "disabled",
+    "killSelection": "YOUNGEST_FIRST",
+    "versionInfo": {"lastScalingAt": "2017-03-07T12:04:15.337Z", "lastConfigChangeAt": "2017-03-07T12:04:15.337Z"},
+    "portDefinitions": [],
+    "ports": [],
+    "requirePorts": false,
+    "someFutureField": {"enabled": true},
+    "tasksStaged": 0,
+    "tasksRunning": 2,
+    "tasksHealthy": 2,
+    "tasksUnhealthy": 0,
+    "deployments": [],
+    "tasks": [{"id": "product_web.1", "appId": "/product/web"}]
+}`)
+
+func TestAppRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	app := &App{}
+	err := json.Unmarshal(marathonApp, app)
+	assert.Nil(t, err)
+
+	assert.Equal(t, NetworkUser, app.Container.Docker.Network)
+	assert.Equal(t, "curl -f http://$HOST:$PORT0/", app.HealthChecks[1].Command.Value)
+	assert.True(t, app.UnreachableStrategy.Disabled)
+	assert.Equal(t, "/web/token", app.Secrets["token"].Source)
+	assert.Equal(t, "WAIT_FOREVER", app.Residency.TaskLostBehavior)
+	assert.Equal(t, map[string]string{"LANG": "C"}, app.Env)
+	assert.Equal(t, map[string]EnvSecret{"SECRET_TOKEN": {"token"}}, app.EnvSecrets)
+
+	serialized, err := json.Marshal(app)
+	assert.Nil(t, err)
+
+	// everything but what Marathon embeds about tasks and deployments comes
+	// back out, unknown fields included
+	var expected, actual map[string]interface{}
+	assert.Nil(t, json.Unmarshal(marathonApp, &expected))
+	assert.Nil(t, json.Unmarshal(serialized, &actual))
+	for _, field := range []string{"tasksStaged", "tasksRunning", "tasksHealthy", "tasksUnhealthy", "deployments", "tasks"} {
+		delete(expected, field)
+	}
+	// and health checks always have a path and port index
+	command := expected["healthChecks"].([]interface{})[1].(map[string]interface{})
+	command["path"], command["portIndex"] = "", 0.0
+	assert.Equal(t, expected, actual)
+}
+
+func TestAppRoundTripNested(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte(`{
+    "id": "/web",
+    "container": {"type": "DOCKER", "docker": {"image": "nginx", "network": "BRIDGE", "pullConfig": {"secret": "registry"}}},
+    "healthChecks": [{"protocol": "HTTP", "path": "/", "ipProtocol": "IPv6"}],
+    "upgradeStrategy": {"minimumHealthCapacity": 1, "maximumOverCapacity": 1, "gracefully": true}
+}`)
+	app := &App{}
+	assert.Nil(t, json.Unmarshal(blob, app))
+
+	// Marathon's newer keys survive inside the fields App knows about, and
+	// changes made to the known ones still come through
+	app.Container.Docker.Image = "nginx:1.15"
+	stored := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(app.Encode(Typed), &stored))
+
+	docker := stored["container"].(map[string]interface{})["docker"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"secret": "registry"}, docker["pullConfig"])
+	assert.Equal(t, "nginx:1.15", docker["image"])
+	assert.Equal(t, "IPv6", stored["healthChecks"].([]interface{})[0].(map[string]interface{})["ipProtocol"])
+	assert.Equal(t, true, stored["upgradeStrategy"].(map[string]interface{})["gracefully"])
+}
+
+func TestUnreachableStrategy(t *testing.T) {
+	t.Parallel()
+
+	strategy := &UnreachableStrategy{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"inactiveAfterSeconds": 300, "expungeAfterSeconds": 600}`), strategy))
+	assert.Equal(t, UnreachableStrategy{InactiveAfterSeconds: 300, ExpungeAfterSeconds: 600}, *strategy)
+
+	assert.Equal(t, ErrBadUnreachableStrategy, json.Unmarshal([]byte(`"sometimes"`), strategy))
+}
+
+func TestAppNamedPortMappings(t *testing.T) {
+	t.Parallel()
+
+	app := &App{}
+	assert.Nil(t, json.Unmarshal(marathonApp, app))
+	assert.Equal(t, []PortDefinition{{Port: 80, Protocol: "tcp", Name: "http", Labels: map[string]string{"VIP_0": "/web:80"}}}, app.NamedPorts())
+}
+
+func TestAppEncode(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte(`{"id": "/web", "instances": 2, "cpus": 0.50, "someFutureField": {"b": 1, "a": 2}, "tasksRunning": 2}`)
+	app := &App{}
+	assert.Nil(t, json.Unmarshal(blob, app))
+
+	// raw keeps Marathon's order and representation, without task counts
+	assert.Equal(t, `{"id":"/web","instances":2,"cpus":0.50,"someFutureField":{"b": 1, "a": 2}}`, string(app.Encode(Raw)))
+	assert.Equal(t, `{"cpus":0.50,"id":"/web","instances":2,"someFutureField":{"a":2,"b":1}}`, string(app.Encode(Canonical)))
+
+	typed, err := json.Marshal(app)
+	assert.Nil(t, err)
+	assert.Equal(t, typed, app.Encode(Typed))
+
+	// without anything from Marathon, there's only the typed encoding
+	built := &App{ID: "/web"}
+	assert.Equal(t, built.KV().Value, built.Encode(Raw))
+
+	// nothing to strip, nothing touched
+	verbatim := []byte(`{ "id" : "/web" }`)
+	assert.Nil(t, json.Unmarshal(verbatim, app))
+	assert.Equal(t, verbatim, app.Encode(Raw))
+}
+
+func TestParseEncoding(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]Encoding{"": Typed, "typed": Typed, "raw": Raw, "canonical": Canonical} {
+		encoding, err := ParseEncoding(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, encoding)
+	}
+
+	_, err := ParseEncoding("yaml")
+	assert.Equal(t, ErrBadEncoding, err)
+}
+
+func TestAppTaskPorts(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte(`{"id": "/web", "container": {"docker": {"network": "USER", "portMappings": [
+		{"containerPort": 8080, "hostPort": 0, "name": "http"},
+		{"containerPort": 9000, "name": "admin"},
+		{"containerPort": 9100, "hostPort": 0, "name": "metrics"}
+	]}}}`)
+	app := &App{}
+	assert.Nil(t, json.Unmarshal(blob, app))
+	assert.Equal(t, []TaskPort{{0, 8080}, {-1, 9000}, {1, 9100}}, app.TaskPorts())
+
+	// mappings without a host port stay that way when stored
+	stored := &App{}
+	assert.Nil(t, json.Unmarshal(app.Encode(Typed), stored))
+	assert.Equal(t, app.TaskPorts(), stored.TaskPorts())
+
+	app.Container.Docker.Network = NetworkBridge
+	assert.Equal(t, []TaskPort{{0, 0}, {1, 0}, {2, 0}}, app.TaskPorts())
+
+	app = &App{PortDefinitions: []PortDefinition{{Port: 0, Name: "http"}}}
+	assert.Equal(t, []TaskPort{{0, 0}}, app.TaskPorts())
+}
+
+func TestAppHostPorts(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte(`{"id": "/web", "container": {"docker": {"network": "USER", "portMappings": [
+		{"containerPort": 8080, "hostPort": 0, "name": "http"},
+		{"containerPort": 9000, "name": "admin"},
+		{"containerPort": 9100, "hostPort": 0, "name": "metrics"}
+	]}}}`)
+	app := &App{}
+	assert.Nil(t, json.Unmarshal(blob, app))
+	assert.Equal(t, []PortDefinition{{Port: 8080, Name: "http"}, {Port: 9100, Name: "metrics"}}, app.HostPorts())
+
+	app = &App{IPAddress: &IPAddress{Discovery: &Discovery{Ports: []DiscoveryPort{{Number: 8080, Name: "http"}}}}}
+	assert.Empty(t, app.HostPorts())
+}
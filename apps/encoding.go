@@ -0,0 +1,67 @@
+package apps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Encoding is how apps are serialized for Consul
+type Encoding string
+
+const (
+	// Typed encodes the fields App knows about, and any unknown fields it
+	// was decoded with
+	Typed Encoding = "typed"
+	// Raw passes apps through as Marathon sent them
+	Raw Encoding = "raw"
+	// Canonical passes apps through compacted, with their keys sorted, so
+	// the same definition is always stored the same way
+	Canonical Encoding = "canonical"
+)
+
+var ErrBadEncoding = errors.New("app encoding must be typed, raw or canonical")
+
+// ParseEncoding parses the name of an Encoding. The empty name is Typed.
+func ParseEncoding(name string) (Encoding, error) {
+	switch encoding := Encoding(name); encoding {
+	case "":
+		return Typed, nil
+	case Typed, Raw, Canonical:
+		return encoding, nil
+	default:
+		return "", ErrBadEncoding
+	}
+}
+
+// Encode serializes the app in encoding. Apps that weren't decoded from
+// Marathon, like those built from an event's app ID, are always Typed.
+func (app *App) Encode(encoding Encoding) []byte {
+	if len(app.raw) == 0 || encoding == Typed || encoding == "" {
+		serialized, _ := json.Marshal(app)
+		return serialized
+	}
+
+	if encoding == Canonical {
+		canonical, err := canonicalize(app.raw)
+		if err == nil {
+			return canonical
+		}
+	}
+
+	return app.raw
+}
+
+// canonicalize compacts data and sorts its keys, keeping numbers as written
+func canonicalize(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,325 @@
+package apps
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// definition is App without its JSON methods, to (un)marshal the known fields
+type definition App
+
+// knownFields are the JSON names of the fields App knows about
+var knownFields = func() map[string]bool {
+	fields := map[string]bool{}
+	appType := reflect.TypeOf(definition{})
+	for i := 0; i < appType.NumField(); i++ {
+		name := strings.Split(appType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// runtimeFields are what Marathon embeds in apps about their tasks and
+// deployments. They aren't part of the definition and change all the time,
+// so they are dropped.
+var runtimeFields = map[string]bool{
+	"deployments":           true,
+	"lastTaskFailure":       true,
+	"readinessCheckResults": true,
+	"taskStats":             true,
+	"tasks":                 true,
+	"tasksHealthy":          true,
+	"tasksRunning":          true,
+	"tasksStaged":           true,
+	"tasksUnhealthy":        true,
+}
+
+// UnmarshalJSON decodes the fields App knows about, and keeps any others
+// Marathon sent aside so MarshalJSON can write them back.
+func (app *App) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	raw, err := withoutRuntime(data, fields)
+	if err != nil {
+		return err
+	}
+
+	// env mixes plain values with secret references, which Env can't hold
+	env, err := splitEnv(fields["env"])
+	if err != nil {
+		return err
+	}
+	delete(fields, "env")
+
+	known := map[string]json.RawMessage{}
+	for name, value := range fields {
+		if knownFields[name] {
+			known[name] = value
+		}
+		if knownFields[name] || runtimeFields[name] {
+			delete(fields, name)
+		}
+	}
+	data, err = json.Marshal(known)
+	if err != nil {
+		return err
+	}
+
+	decoded := definition{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	typed, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+
+	*app = App(decoded)
+	app.nested = extraFields(data, typed)
+	app.Env, app.EnvSecrets = env.values, env.secrets
+	if len(fields) > 0 {
+		app.unknown = fields
+	}
+	app.raw = raw
+	return nil
+}
+
+// withoutRuntime returns a copy of the app object data without its
+// runtimeFields. Everything else is kept as Marathon wrote it, in order.
+func withoutRuntime(data []byte, fields map[string]json.RawMessage) (json.RawMessage, error) {
+	runtime := false
+	for name := range fields {
+		runtime = runtime || runtimeFields[name]
+	}
+	if !runtime {
+		return append(json.RawMessage{}, data...), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	stripped := bytes.NewBufferString("{")
+	for decoder.More() {
+		name, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		value := json.RawMessage{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		if runtimeFields[name.(string)] {
+			continue
+		}
+
+		if stripped.Len() > 1 {
+			stripped.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		stripped.Write(key)
+		stripped.WriteByte(':')
+		stripped.Write(value)
+	}
+	stripped.WriteByte('}')
+
+	return stripped.Bytes(), nil
+}
+
+// MarshalJSON encodes the fields App knows about, along with its secret
+// environment variables and any unknown fields it was decoded with
+func (app App) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(definition(app))
+	if err == nil && app.nested != nil {
+		known, _, err = mergeExtra(known, app.nested)
+	}
+	if err != nil || (len(app.unknown) == 0 && len(app.EnvSecrets) == 0) {
+		return known, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(known, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range app.unknown {
+		fields[name] = value
+	}
+
+	if len(app.EnvSecrets) > 0 {
+		env := make(map[string]interface{}, len(app.Env)+len(app.EnvSecrets))
+		for name, value := range app.Env {
+			env[name] = value
+		}
+		for name, secret := range app.EnvSecrets {
+			env[name] = secret
+		}
+		fields["env"], err = json.Marshal(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// extraFields returns what raw has that typed, its re-encoding, doesn't: a
+// map of the missing keys to their values as json.RawMessage, and of the
+// keys missing something to what they miss, in the same form. Arrays of the
+// same length are compared item by item, with nil for the items missing
+// nothing. It returns nil if nothing is missing.
+func extraFields(raw, typed json.RawMessage) interface{} {
+	rawFields, typedFields := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	if isObject(raw) && isObject(typed) &&
+		json.Unmarshal(raw, &rawFields) == nil && json.Unmarshal(typed, &typedFields) == nil {
+		extra := map[string]interface{}{}
+		for name, value := range rawFields {
+			typedValue, ok := typedFields[name]
+			if !ok {
+				extra[name] = value
+			} else if missing := extraFields(value, typedValue); missing != nil {
+				extra[name] = missing
+			}
+		}
+		if len(extra) == 0 {
+			return nil
+		}
+		return extra
+	}
+
+	rawItems, typedItems := []json.RawMessage{}, []json.RawMessage{}
+	if json.Unmarshal(raw, &rawItems) != nil || json.Unmarshal(typed, &typedItems) != nil ||
+		len(rawItems) != len(typedItems) {
+		return nil
+	}
+	extra := make([]interface{}, len(rawItems))
+	missing := false
+	for i := range rawItems {
+		extra[i] = extraFields(rawItems[i], typedItems[i])
+		missing = missing || extra[i] != nil
+	}
+	if !missing {
+		return nil
+	}
+	return extra
+}
+
+// mergeExtra adds what extraFields found missing back into data, where data
+// still has a place for it, and tells whether it added anything. data is
+// only re-encoded if it did, so its keys otherwise keep their order.
+func mergeExtra(data json.RawMessage, extra interface{}) (json.RawMessage, bool, error) {
+	switch extra := extra.(type) {
+	case map[string]interface{}:
+		fields := map[string]json.RawMessage{}
+		if !isObject(data) || json.Unmarshal(data, &fields) != nil {
+			return data, false, nil
+		}
+
+		merged := false
+		for name, missing := range extra {
+			value, ok := fields[name]
+			if !ok {
+				if raw, isRaw := missing.(json.RawMessage); isRaw {
+					fields[name] = raw
+					merged = true
+				}
+				continue
+			}
+
+			value, added, err := mergeExtra(value, missing)
+			if err != nil {
+				return nil, false, err
+			}
+			fields[name] = value
+			merged = merged || added
+		}
+		if !merged {
+			return data, false, nil
+		}
+		data, err := json.Marshal(fields)
+		return data, err == nil, err
+
+	case []interface{}:
+		items := []json.RawMessage{}
+		if json.Unmarshal(data, &items) != nil || len(items) != len(extra) {
+			return data, false, nil
+		}
+
+		merged := false
+		for i, missing := range extra {
+			if missing == nil {
+				continue
+			}
+			item, added, err := mergeExtra(items[i], missing)
+			if err != nil {
+				return nil, false, err
+			}
+			items[i] = item
+			merged = merged || added
+		}
+		if !merged {
+			return data, false, nil
+		}
+		data, err := json.Marshal(items)
+		return data, err == nil, err
+	}
+
+	return data, false, nil
+}
+
+func isObject(data json.RawMessage) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+type env struct {
+	values  map[string]string
+	secrets map[string]EnvSecret
+}
+
+// splitEnv splits env into plain values and secret references
+func splitEnv(data json.RawMessage) (env, error) {
+	split := env{}
+	if len(data) == 0 {
+		return split, nil
+	}
+
+	vars := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &vars)
+	if err != nil || vars == nil {
+		return split, err
+	}
+
+	split.values = make(map[string]string, len(vars))
+	for name, value := range vars {
+		var plain string
+		if json.Unmarshal(value, &plain) == nil {
+			split.values[name] = plain
+			continue
+		}
+
+		secret := EnvSecret{}
+		err = json.Unmarshal(value, &secret)
+		if err != nil {
+			return split, err
+		}
+		if split.secrets == nil {
+			split.secrets = map[string]EnvSecret{}
+		}
+		split.secrets[name] = secret
+	}
+
+	return split, nil
+}
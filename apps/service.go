@@ -0,0 +1,230 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CiscoCloud/marathon-consul/utils"
+)
+
+// Labels that say how an app's tasks are exposed as Consul services:
+//
+//	consul.register=false          don't register the app's tasks
+//	consul.service.name=<name>     register them as <name>, not the app ID
+//	consul.service.tags=<a>,<b>    tag the service
+//	consul.service.meta.<key>=<v>  add metadata to the service
+//	consul.port.<name>=<index>     register the task port at <index> as <name>
+//	consul.connect=true            register a Connect sidecar proxy too
+//	consul.connect.upstreams=<service>:<port>,...
+//	                               have the sidecar proxy <service> on the
+//	                               task's localhost at <port>
+//
+// Without consul.port labels, the ports named in the app's port definitions
+// or mappings are registered. Any other label starting with consul. is an error, to catch typos.
+const (
+	LabelPrefix      = "consul."
+	LabelRegister    = "consul.register"
+	LabelServiceName = "consul.service.name"
+	LabelServiceTags = "consul.service.tags"
+	LabelServiceMeta = "consul.service.meta."
+	LabelPort        = "consul.port."
+	LabelConnect     = "consul.connect"
+	LabelUpstreams   = "consul.connect.upstreams"
+)
+
+var (
+	ErrUnknownLabel   = errors.New("unknown consul label")
+	ErrBadBool        = errors.New("must be true or false")
+	ErrBadServiceName = errors.New("may only contain letters, digits and dashes")
+	ErrBadTag         = errors.New("tags can't be empty")
+	ErrBadMetaKey     = errors.New("metadata keys may only contain letters, digits, dashes and underscores")
+	ErrBadPortIndex   = errors.New("must be the index of one of the app's ports")
+	ErrBadUpstream    = errors.New("upstreams must be <service>:<port>, with a port between 1 and 65535")
+)
+
+var (
+	serviceName = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+	metaKey     = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// LabelError is a label Service couldn't make sense of
+type LabelError struct {
+	Label string
+	Value string
+	Err   error
+}
+
+func (e *LabelError) Error() string {
+	return fmt.Sprintf("label %s=%q: %s", e.Label, e.Value, e.Err)
+}
+
+// ServicePort is a task port registered with Consul
+type ServicePort struct {
+	// Name is empty for the service's default port
+	Name  string
+	Index int
+}
+
+// Upstream is a service a Connect sidecar proxy makes available to its task
+// on a local port
+type Upstream struct {
+	Service   string
+	LocalPort int
+}
+
+// Service is how an app's tasks are exposed as Consul services
+type Service struct {
+	Register bool
+	Name     string
+	Tags     []string
+	Meta     map[string]string
+	// Ports are sorted by name. Without consul.port labels, every named port
+	// of the app is registered, or the first port if none are named.
+	Ports []ServicePort
+	// TaskPorts tells where tasks serve the app's named ports, which
+	// ServicePort indices refer to. It's empty when the app doesn't name its
+	// ports, and indices are those of tasks' Ports.
+	TaskPorts []TaskPort
+	// Connect registers a sidecar proxy with every service, proxying
+	// Upstreams
+	Connect   bool
+	Upstreams []Upstream
+}
+
+// Service reads how the app's tasks are exposed as Consul services from its
+// labels. Labels that don't parse are left out and returned as LabelErrors,
+// so one bad label doesn't keep the app from being registered.
+func (app *App) Service() (Service, []error) {
+	service := Service{
+		Register: true,
+		Name:     utils.CleanID(app.ID),
+		Meta:     map[string]string{},
+	}
+	problems := []error{}
+	fail := func(label, value string, err error) {
+		problems = append(problems, &LabelError{label, value, err})
+	}
+
+	ports := len(app.NamedPorts())
+	if ports == 0 {
+		ports = len(app.Ports)
+	} else {
+		service.TaskPorts = app.TaskPorts()
+	}
+
+	// in order, so the same labels always give the same errors
+	labels := make([]string, 0, len(app.Labels))
+	for label := range app.Labels {
+		if strings.HasPrefix(label, LabelPrefix) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		value := app.Labels[label]
+		switch {
+		case label == LabelRegister:
+			register, err := strconv.ParseBool(value)
+			if err != nil {
+				fail(label, value, ErrBadBool)
+				continue
+			}
+			service.Register = register
+
+		case label == LabelServiceName:
+			if !serviceName.MatchString(value) {
+				fail(label, value, ErrBadServiceName)
+				continue
+			}
+			service.Name = value
+
+		case label == LabelServiceTags:
+			for _, tag := range strings.Split(value, ",") {
+				tag = strings.TrimSpace(tag)
+				if tag == "" {
+					fail(label, value, ErrBadTag)
+					continue
+				}
+				service.Tags = append(service.Tags, tag)
+			}
+
+		case strings.HasPrefix(label, LabelServiceMeta):
+			key := strings.TrimPrefix(label, LabelServiceMeta)
+			if !metaKey.MatchString(key) {
+				fail(label, value, ErrBadMetaKey)
+				continue
+			}
+			service.Meta[key] = value
+
+		case strings.HasPrefix(label, LabelPort):
+			name := strings.TrimPrefix(label, LabelPort)
+			if !serviceName.MatchString(name) {
+				fail(label, value, ErrBadServiceName)
+				continue
+			}
+			index, err := strconv.Atoi(value)
+			if err != nil || index < 0 || (ports > 0 && index >= ports) {
+				fail(label, value, ErrBadPortIndex)
+				continue
+			}
+			service.Ports = append(service.Ports, ServicePort{Name: name, Index: index})
+
+		case label == LabelConnect:
+			connect, err := strconv.ParseBool(value)
+			if err != nil {
+				fail(label, value, ErrBadBool)
+				continue
+			}
+			service.Connect = connect
+
+		case label == LabelUpstreams:
+			for _, upstream := range strings.Split(value, ",") {
+				parts := strings.Split(strings.TrimSpace(upstream), ":")
+				if len(parts) != 2 || !serviceName.MatchString(parts[0]) {
+					fail(label, value, ErrBadUpstream)
+					continue
+				}
+				port, err := strconv.Atoi(parts[1])
+				if err != nil || port < 1 || port > 65535 {
+					fail(label, value, ErrBadUpstream)
+					continue
+				}
+				service.Upstreams = append(service.Upstreams, Upstream{parts[0], port})
+			}
+
+		default:
+			fail(label, value, ErrUnknownLabel)
+		}
+	}
+
+	if len(service.Ports) == 0 && ports > 0 {
+		service.Ports = app.namedServicePorts()
+	}
+
+	return service, problems
+}
+
+// namedServicePorts registers every port named in the app's port definitions
+// or mappings, or the first port if none are
+func (app *App) namedServicePorts() []ServicePort {
+	ports := []ServicePort{}
+	seen := map[string]bool{}
+	for i, port := range app.NamedPorts() {
+		if port.Name == "" || seen[port.Name] || !serviceName.MatchString(port.Name) {
+			continue
+		}
+		seen[port.Name] = true
+		ports = append(ports, ServicePort{Name: port.Name, Index: i})
+	}
+	if len(ports) == 0 {
+		return []ServicePort{{Index: 0}}
+	}
+
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports
+}
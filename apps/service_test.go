@@ -0,0 +1,136 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceDefaults(t *testing.T) {
+	t.Parallel()
+
+	service, problems := (&App{ID: "/product/web", Ports: []int{10000, 10001}}).Service()
+	assert.Len(t, problems, 0)
+	assert.True(t, service.Register)
+	assert.Equal(t, "product-web", service.Name)
+	assert.Equal(t, []ServicePort{{Index: 0}}, service.Ports)
+}
+
+func TestServiceLabels(t *testing.T) {
+	t.Parallel()
+
+	app := &App{
+		ID:    "/product/web",
+		Ports: []int{10000, 10001},
+		Labels: map[string]string{
+			"consul.service.name":      "web",
+			"consul.service.tags":      "a, b",
+			"consul.service.meta.team": "product",
+			"consul.port.http":         "0",
+			"consul.port.admin":        "1",
+			"HAPROXY_GROUP":            "external",
+		},
+	}
+
+	service, problems := app.Service()
+	assert.Len(t, problems, 0)
+	assert.Equal(t, Service{
+		Register: true,
+		Name:     "web",
+		Tags:     []string{"a", "b"},
+		Meta:     map[string]string{"team": "product"},
+		Ports:    []ServicePort{{"admin", 1}, {"http", 0}},
+	}, service)
+
+	app.Labels = map[string]string{"consul.register": "false"}
+	service, problems = app.Service()
+	assert.Len(t, problems, 0)
+	assert.False(t, service.Register)
+}
+
+func TestServiceBadLabels(t *testing.T) {
+	t.Parallel()
+
+	app := &App{
+		ID:    "/web",
+		Ports: []int{10000},
+		Labels: map[string]string{
+			"consul.register":         "maybe",
+			"consul.service.name":     "web_app",
+			"consul.service.tags":     "a,,b",
+			"consul.service.meta.a.b": "c",
+			"consul.port.http":        "1",
+			"consul.servce.name":      "typo",
+			"consul.port.admin":       "0",
+		},
+	}
+
+	service, problems := app.Service()
+	assert.Equal(t, []error{
+		&LabelError{"consul.port.http", "1", ErrBadPortIndex},
+		&LabelError{"consul.register", "maybe", ErrBadBool},
+		&LabelError{"consul.servce.name", "typo", ErrUnknownLabel},
+		&LabelError{"consul.service.meta.a.b", "c", ErrBadMetaKey},
+		&LabelError{"consul.service.name", "web_app", ErrBadServiceName},
+		&LabelError{"consul.service.tags", "a,,b", ErrBadTag},
+	}, problems)
+
+	// the good parts still count
+	assert.True(t, service.Register)
+	assert.Equal(t, "web", service.Name)
+	assert.Equal(t, []string{"a", "b"}, service.Tags)
+	assert.Equal(t, []ServicePort{{"admin", 0}}, service.Ports)
+}
+
+func TestServiceNamedPorts(t *testing.T) {
+	t.Parallel()
+
+	app := &App{
+		ID: "/web",
+		PortDefinitions: []PortDefinition{
+			{Port: 10000, Name: "http"},
+			{Port: 10001},
+			{Port: 10002, Name: "metrics"},
+		},
+	}
+
+	service, problems := app.Service()
+	assert.Len(t, problems, 0)
+	assert.Equal(t, []ServicePort{{"http", 0}, {"metrics", 2}}, service.Ports)
+
+	// labels win
+	app.Labels = map[string]string{"consul.port.web": "1"}
+	service, _ = app.Service()
+	assert.Equal(t, []ServicePort{{"web", 1}}, service.Ports)
+}
+
+func TestServiceConnect(t *testing.T) {
+	t.Parallel()
+
+	app := &App{
+		ID:    "/web",
+		Ports: []int{10000},
+		Labels: map[string]string{
+			"consul.connect":           "true",
+			"consul.connect.upstreams": "db:5432, cache:6379",
+		},
+	}
+
+	service, problems := app.Service()
+	assert.Len(t, problems, 0)
+	assert.True(t, service.Connect)
+	assert.Equal(t, []Upstream{{"db", 5432}, {"cache", 6379}}, service.Upstreams)
+
+	app.Labels = map[string]string{
+		"consul.connect":           "yes",
+		"consul.connect.upstreams": "db:5432,cache,queue:0",
+	}
+	service, problems = app.Service()
+	assert.Equal(t, []error{
+		&LabelError{"consul.connect", "yes", ErrBadBool},
+		&LabelError{"consul.connect.upstreams", "db:5432,cache,queue:0", ErrBadUpstream},
+		&LabelError{"consul.connect.upstreams", "db:5432,cache,queue:0", ErrBadUpstream},
+	}, problems)
+	assert.False(t, service.Connect)
+	assert.Equal(t, []Upstream{{"db", 5432}}, service.Upstreams)
+}
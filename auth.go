@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body,
+// keyed with the shared secret
+const SignatureHeader = "X-Marathon-Consul-Signature"
+
+// WebhookAuth guards the /events endpoint. Every configured check must pass;
+// an unconfigured check is skipped, so the zero value lets everything in.
+type WebhookAuth struct {
+	// Secret must either sign the body (see SignatureHeader) or be passed
+	// as the "secret" query parameter, since Marathon's own HTTP callbacks
+	// can't sign requests
+	Secret   string
+	Username string
+	Password string
+	Allow    []*net.IPNet
+
+	lock     sync.Mutex
+	rejected map[string]int
+}
+
+// Wrap returns a handler that only passes authenticated requests on to next
+func (wa *WebhookAuth) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason := wa.check(r); reason != "" {
+			wa.reject(r, reason)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "forbidden")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// check returns the reason a request is rejected, or "" if it is allowed
+func (wa *WebhookAuth) check(r *http.Request) string {
+	if len(wa.Allow) > 0 && !wa.allowed(r.RemoteAddr) {
+		return "address"
+	}
+
+	if wa.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || !equal(username, wa.Username) || !equal(password, wa.Password) {
+			return "credentials"
+		}
+	}
+
+	if wa.Secret != "" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "unreadable body"
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if !wa.signed(r, body) && !equal(r.URL.Query().Get("secret"), wa.Secret) {
+			return "signature"
+		}
+	}
+
+	return ""
+}
+
+func (wa *WebhookAuth) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range wa.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (wa *WebhookAuth) signed(r *http.Request, body []byte) bool {
+	signature := strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256=")
+	if signature == "" {
+		return false
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(wa.Secret))
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+func (wa *WebhookAuth) reject(r *http.Request, reason string) {
+	wa.lock.Lock()
+	if wa.rejected == nil {
+		wa.rejected = map[string]int{}
+	}
+	wa.rejected[reason]++
+	wa.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"remote": r.RemoteAddr,
+		"reason": reason,
+	}).Warn("rejected webhook request")
+}
+
+// Status reports how many requests were rejected, by reason
+func (wa *WebhookAuth) Status() interface{} {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+
+	rejected := make(map[string]int, len(wa.rejected))
+	for reason, count := range wa.rejected {
+		rejected[reason] = count
+	}
+	return map[string]interface{}{"rejected": rejected}
+}
+
+// equal compares secrets in constant time
+func equal(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
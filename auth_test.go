@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func authRequest(wa *WebhookAuth, req *http.Request) int {
+	recorder := httptest.NewRecorder()
+	wa.Wrap(okHandler)(recorder, req)
+	return recorder.Code
+}
+
+func TestWebhookAuthOpen(t *testing.T) {
+	t.Parallel()
+
+	req, _ := http.NewRequest("POST", "http://example.com/events", strings.NewReader("{}"))
+	assert.Equal(t, 200, authRequest(&WebhookAuth{}, req))
+}
+
+func TestWebhookAuthAllow(t *testing.T) {
+	t.Parallel()
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	wa := &WebhookAuth{Allow: []*net.IPNet{network}}
+
+	req, _ := http.NewRequest("POST", "http://example.com/events", nil)
+	req.RemoteAddr = "10.1.2.3:51000"
+	assert.Equal(t, 200, authRequest(wa, req))
+
+	req.RemoteAddr = "192.168.1.1:51000"
+	assert.Equal(t, 403, authRequest(wa, req))
+
+	assert.Equal(t, map[string]interface{}{
+		"rejected": map[string]int{"address": 1},
+	}, wa.Status())
+}
+
+func TestWebhookAuthBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	wa := &WebhookAuth{Username: "marathon", Password: "secret"}
+
+	req, _ := http.NewRequest("POST", "http://example.com/events", nil)
+	assert.Equal(t, 403, authRequest(wa, req))
+
+	req.SetBasicAuth("marathon", "wrong")
+	assert.Equal(t, 403, authRequest(wa, req))
+
+	req.SetBasicAuth("marathon", "secret")
+	assert.Equal(t, 200, authRequest(wa, req))
+}
+
+func TestWebhookAuthSecret(t *testing.T) {
+	t.Parallel()
+
+	wa := &WebhookAuth{Secret: "s3cret"}
+	body := `{"eventType": "app_terminated_event", "appId": "/test"}`
+
+	// unsigned
+	req, _ := http.NewRequest("POST", "http://example.com/events", strings.NewReader(body))
+	assert.Equal(t, 403, authRequest(wa, req))
+
+	// signed
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	req, _ = http.NewRequest("POST", "http://example.com/events", strings.NewReader(body))
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	assert.Equal(t, 200, authRequest(wa, req))
+
+	// signed with the wrong secret
+	mac = hmac.New(sha256.New, []byte("wrong"))
+	mac.Write([]byte(body))
+	req, _ = http.NewRequest("POST", "http://example.com/events", strings.NewReader(body))
+	req.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	assert.Equal(t, 403, authRequest(wa, req))
+
+	// secret in the callback URL
+	req, _ = http.NewRequest("POST", "http://example.com/events?secret=s3cret", strings.NewReader(body))
+	assert.Equal(t, 200, authRequest(wa, req))
+}
@@ -1,28 +1,45 @@
 package config
 
 import (
-	"crypto/tls"
 	"errors"
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/tasks"
 	log "github.com/Sirupsen/logrus"
 	"github.com/hashicorp/consul/api"
 	flag "github.com/ogier/pflag"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 var (
-	ErrBadCredentials = errors.New("credentials must be of the form `user:pass`")
-	ErrNoScheme       = errors.New("please specify a scheme for the registry")
+	ErrBadCredentials   = errors.New("credentials must be of the form `user:pass`")
+	ErrNoScheme         = errors.New("please specify a scheme for the registry")
+	ErrAmbiguousTargets = errors.New("specify several registry locations or several registry datacenters, not both")
 )
 
 type Config struct {
-	Registry Registry
-	Web      struct {
-		Listen string
-	}
-	Marathon MarathonConfig
-	LogLevel string
+	Registry        Registry
+	Web             Web
+	Marathon        MarathonConfig
+	LogLevel        string
+	ShutdownTimeout time.Duration
+	// TaskStates overrides what each task state does, see tasks.ParsePolicy
+	TaskStates    string
+	TaskMarkGrace time.Duration
+	// TaskTombstones is how long removed tasks are kept under
+	// <app>/terminated, or 0 to delete them outright
+	TaskTombstones time.Duration
+	// AppVersions is how many of each app's latest definitions a sync keeps
+	AppVersions int
+	// AppJSON is how apps are serialized, see apps.ParseEncoding
+	AppJSON string
+	// RegisterServices registers tasks as Consul services, see apps.Service
+	RegisterServices bool
+	// RegisterAgent, if set, is a template for the address of the agent on
+	// each task's host to register it with, see consul.NewLocalAgents
+	RegisterAgent string
 }
 
 func New() (config *Config) {
@@ -39,27 +56,64 @@ func New() (config *Config) {
 func (config *Config) parseFlags() {
 	// registry
 	flag.StringVar(&config.Registry.Auth, "registry-auth", "", "Registry basic auth")
-	flag.StringVar(&config.Registry.Datacenter, "registry-datacenter", "", "Registry datacenter")
-	flag.StringVar(&config.Registry.Location, "registry", "http://localhost:8500", "Registry location")
+	flag.StringVar(&config.Registry.Datacenter, "registry-datacenter", "", "Registry datacenter (comma-separated to mirror to several)")
+	flag.StringVar(&config.Registry.Location, "registry", "http://localhost:8500", "Registry location (comma-separated to mirror to several)")
 	flag.StringVar(&config.Registry.Token, "registry-token", "", "Registry ACL token")
-	flag.BoolVar(&config.Registry.NoVerifySSL, "registry-noverify", false, "don't verify registry SSL certificates")
+	flag.BoolVar(&config.Registry.TLS.NoVerify, "registry-noverify", false, "don't verify registry SSL certificates")
+	flag.StringVar(&config.Registry.TLS.CAFile, "registry-ca-file", "", "CA bundle to verify registry SSL certificates with")
+	flag.StringVar(&config.Registry.TLS.CertFile, "registry-cert-file", "", "client certificate to present to the registry")
+	flag.StringVar(&config.Registry.TLS.KeyFile, "registry-key-file", "", "key for the registry client certificate")
+	flag.StringVar(&config.Registry.TLS.ServerName, "registry-tls-server-name", "", "server name to verify registry SSL certificates against")
 	flag.StringVar(&config.Registry.Prefix, "registry-prefix", "marathon", "prefix for all values sent to the registry")
+	flag.IntVar(&config.Registry.Concurrency, "registry-concurrency", 4, "how many registry writes a sync may run at once")
+	flag.Float64Var(&config.Registry.RateLimit, "registry-rate-limit", 0, "most registry writes per second a sync may start (0 for no limit)")
 
 	// Web
 	flag.StringVar(&config.Web.Listen, "listen", ":4000", "accept connections at this address")
+	flag.BoolVar(&config.Web.Subscribe, "webhook-subscribe", false, "manage Marathon's event subscription for this process (Marathon < 0.9.0, needs --webhook-advertise)")
+	flag.StringVar(&config.Web.Advertise, "webhook-advertise", "", "base URL Marathon reaches this process at, for event subscriptions")
+	flag.StringVar(&config.Web.Secret, "webhook-secret", "", "shared secret /events requests must carry or be signed with")
+	flag.StringVar(&config.Web.Auth, "webhook-auth", "", "basic auth /events requests must carry, as user:pass")
+	flag.StringVar(&config.Web.AllowFrom, "webhook-allow", "", "comma-separated IPs and CIDR blocks allowed to post to /events")
+	flag.StringVar(&config.Web.CertFile, "webhook-cert-file", "", "serve HTTPS with this certificate")
+	flag.StringVar(&config.Web.KeyFile, "webhook-key-file", "", "key for the HTTPS certificate")
 
 	// Marathon
-	flag.StringVar(&config.Marathon.Location, "marathon-location", "localhost:8080", "marathon URL")
+	flag.StringVar(&config.Marathon.Location, "marathon-location", "localhost:8080", "marathon URL (comma-separated for several masters, or consul://<service>)")
 	flag.StringVar(&config.Marathon.Protocol, "marathon-protocol", "http", "marathon protocol (http or https)")
 	flag.StringVar(&config.Marathon.Username, "marathon-username", "", "marathon username for basic auth")
 	flag.StringVar(&config.Marathon.Password, "marathon-password", "", "marathon password for basic auth")
+	flag.BoolVar(&config.Marathon.TLS.NoVerify, "marathon-noverify", false, "don't verify marathon SSL certificates")
+	flag.StringVar(&config.Marathon.TLS.CAFile, "marathon-ca-file", "", "CA bundle to verify marathon SSL certificates with")
+	flag.StringVar(&config.Marathon.TLS.CertFile, "marathon-cert-file", "", "client certificate to present to marathon")
+	flag.StringVar(&config.Marathon.TLS.KeyFile, "marathon-key-file", "", "key for the marathon client certificate")
+	flag.StringVar(&config.Marathon.Token, "marathon-token", "", "DC/OS ACS token for marathon")
+	flag.StringVar(&config.Marathon.ServiceAccountFile, "marathon-service-account-file", "", "DC/OS service account secret to log in with (refreshes the token automatically)")
 
 	// General
 	flag.StringVar(&config.LogLevel, "log-level", "info", "log level: panic, fatal, error, warn, info, or debug")
+	flag.StringVar(&config.TaskStates, "task-states", "", "comma-separated state=keep|mark|remove overrides, e.g. TASK_UNREACHABLE=remove")
+	flag.DurationVar(&config.TaskMarkGrace, "task-mark-grace", 5*time.Minute, "how long a marked task (e.g. TASK_UNREACHABLE) is kept before it is removed")
+	flag.DurationVar(&config.TaskTombstones, "task-tombstones", 0, "keep removed tasks under <app>/terminated for this long (0 to delete them outright)")
+	flag.StringVar(&config.AppJSON, "app-json", "typed", "how to store apps: typed, raw (as Marathon sent them) or canonical (raw, compacted with sorted keys)")
+	flag.BoolVar(&config.RegisterServices, "register-services", false, "register a Consul service per named port of each task (see the consul.* app labels)")
+	flag.StringVar(&config.RegisterAgent, "register-agent", "", "register each task with the Consul agent on its host at this address, e.g. http://{{.Host}}:8500 (default: the registry agent)")
+	flag.IntVar(&config.AppVersions, "app-versions", 0, "keep this many of each app's latest definitions under <app>/versions (0 to keep none)")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for queued events and writes when shutting down")
 
 	flag.Parse()
 }
 
+// TaskPolicy returns what status updates do to tasks in each state
+func (config *Config) TaskPolicy() (tasks.Policy, error) {
+	return tasks.ParsePolicy(config.TaskStates, config.TaskMarkGrace)
+}
+
+// AppEncoding returns how apps are serialized for the registry
+func (config *Config) AppEncoding() (apps.Encoding, error) {
+	return apps.ParseEncoding(config.AppJSON)
+}
+
 func (config *Config) setLogLevel() {
 	level, err := log.ParseLevel(config.LogLevel)
 	if err != nil {
@@ -69,12 +123,15 @@ func (config *Config) setLogLevel() {
 }
 
 type Registry struct {
-	Auth        string
-	Datacenter  string
-	Location    string
-	Token       string
-	NoVerifySSL bool
-	Prefix      string
+	Auth       string
+	Datacenter string
+	Location   string
+	Token      string
+	TLS        TLS
+	Prefix     string
+	// Concurrency and RateLimit bound the writes of a sync, per target
+	Concurrency int
+	RateLimit   float64
 }
 
 func (r Registry) GetAuth() (auth *api.HttpBasicAuth, err error) {
@@ -109,6 +166,11 @@ func (r Registry) Config() (*api.Config, error) {
 		return nil, err
 	}
 
+	tlsConfig, err := r.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+
 	config := &api.Config{
 		Address:    url.Host,
 		Scheme:     url.Scheme,
@@ -117,13 +179,57 @@ func (r Registry) Config() (*api.Config, error) {
 		Token:      r.Token,
 		HttpClient: &http.Client{
 			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: r.NoVerifySSL,
-				},
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
 			},
 		},
 	}
 
 	return config, nil
 }
+
+// Configs returns one Config per registry target. Both Location and
+// Datacenter may be comma-separated lists: several locations mirror to
+// independent Consul clusters, several datacenters mirror to WAN-federated
+// datacenters through a single agent.
+func (r Registry) Configs() ([]*api.Config, error) {
+	locations := splitList(r.Location)
+	datacenters := splitList(r.Datacenter)
+	if len(locations) > 1 && len(datacenters) > 1 {
+		return nil, ErrAmbiguousTargets
+	}
+	if len(locations) == 0 {
+		locations = []string{""}
+	}
+	if len(datacenters) == 0 {
+		datacenters = []string{""}
+	}
+
+	configs := []*api.Config{}
+	for _, location := range locations {
+		for _, datacenter := range datacenters {
+			target := r
+			target.Location = location
+			target.Datacenter = datacenter
+
+			config, err := target.Config()
+			if err != nil {
+				return nil, err
+			}
+			configs = append(configs, config)
+		}
+	}
+
+	return configs, nil
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/stretchr/testify/assert"
+	"net/http"
 	"testing"
 )
 
@@ -41,3 +42,53 @@ func TestRegistryConfigURL(t *testing.T) {
 	assert.Nil(t, c)
 	assert.Equal(t, err, ErrNoScheme)
 }
+
+func TestRegistryConfigsDatacenters(t *testing.T) {
+	t.Parallel()
+
+	reg := Registry{Location: "http://localhost:8500", Datacenter: "dc1, dc2"}
+	configs, err := reg.Configs()
+	assert.Nil(t, err)
+	if assert.Len(t, configs, 2) {
+		assert.Equal(t, "dc1", configs[0].Datacenter)
+		assert.Equal(t, "dc2", configs[1].Datacenter)
+		assert.Equal(t, "localhost:8500", configs[1].Address)
+	}
+}
+
+func TestRegistryConfigsLocations(t *testing.T) {
+	t.Parallel()
+
+	reg := Registry{Location: "http://consul-a:8500,https://consul-b:8500"}
+	configs, err := reg.Configs()
+	assert.Nil(t, err)
+	if assert.Len(t, configs, 2) {
+		assert.Equal(t, "consul-a:8500", configs[0].Address)
+		assert.Equal(t, "https", configs[1].Scheme)
+	}
+
+	reg.Datacenter = "dc1,dc2"
+	configs, err = reg.Configs()
+	assert.Nil(t, configs)
+	assert.Equal(t, ErrAmbiguousTargets, err)
+}
+
+func TestRegistryConfigTLS(t *testing.T) {
+	t.Parallel()
+
+	reg := Registry{
+		Location: "https://consul.service.consul:8500",
+		TLS:      TLS{ServerName: "server.dc1.consul"},
+	}
+	c, err := reg.Config()
+	assert.Nil(t, err)
+
+	transport := c.HttpClient.Transport.(*http.Transport)
+	assert.Equal(t, "server.dc1.consul", transport.TLSClientConfig.ServerName)
+	assert.False(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	reg.TLS = TLS{KeyFile: "key.pem"}
+	c, err = reg.Config()
+	assert.Nil(t, c)
+	assert.Equal(t, ErrCertWithKey, err)
+}
@@ -1,17 +1,29 @@
 package config
 
 import (
+	"crypto/tls"
+	"github.com/CiscoCloud/marathon-consul/consul"
 	"github.com/CiscoCloud/marathon-consul/marathon"
 	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"strings"
 )
 
+// locations starting with this scheme name a service in the Consul catalog
+// instead of a fixed list of hosts, e.g. consul://marathon
+const consulLocationScheme = "consul://"
+
 type MarathonConfig struct {
-	Location string
-	Protocol string
-	Username string
-	Password string
+	Location           string
+	Protocol           string
+	Username           string
+	Password           string
+	TLS                TLS
+	Token              string
+	ServiceAccountFile string
 }
 
 func (m MarathonConfig) Validate() {
@@ -22,12 +34,72 @@ func (m MarathonConfig) Validate() {
 	}
 }
 
-func (m MarathonConfig) NewMarathon() (marathon.Marathon, error) {
+// NewMarathon creates a Marathon client. registry is used to look up healthy
+// Marathon instances when the location is a consul:// service.
+func (m MarathonConfig) NewMarathon(registry *api.Config) (marathon.Marathon, error) {
 	m.Validate()
 
-	return marathon.NewMarathon(
-		m.Location,
+	remote, err := m.newMarathon(registry)
+	if err != nil {
+		return remote, err
+	}
+
+	remote.NoVerifySsl = m.TLS.NoVerify
+	remote.TLSConfig, err = m.TLS.Config()
+	if err != nil {
+		return remote, err
+	}
+
+	remote.Token, err = m.tokenSource(remote.TLSConfig)
+	return remote, err
+}
+
+func (m MarathonConfig) newMarathon(registry *api.Config) (marathon.Marathon, error) {
+	auth := url.UserPassword(m.Username, m.Password)
+
+	if !strings.HasPrefix(m.Location, consulLocationScheme) {
+		return marathon.NewMarathon(m.Location, m.Protocol, auth)
+	}
+
+	service := strings.TrimPrefix(m.Location, consulLocationScheme)
+	catalog, err := consul.NewCatalog(registry)
+	if err != nil {
+		return marathon.Marathon{}, err
+	}
+
+	log.WithField("service", service).Info("resolving Marathon through the Consul catalog")
+	return marathon.NewResolvedMarathon(
+		func() ([]string, error) { return catalog.Resolve(service) },
 		m.Protocol,
-		url.UserPassword(m.Username, m.Password),
+		auth,
 	)
 }
+
+// tokenSource returns the DC/OS token source to use, if any. A service account
+// logs in with the same TLS settings used to talk to Marathon.
+func (m MarathonConfig) tokenSource(tlsConfig *tls.Config) (marathon.TokenSource, error) {
+	if m.ServiceAccountFile != "" {
+		blob, err := ioutil.ReadFile(m.ServiceAccountFile)
+		if err != nil {
+			return nil, err
+		}
+
+		account, err := marathon.ParseServiceAccount(blob)
+		if err != nil {
+			return nil, err
+		}
+		account.Client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+		return account, nil
+	}
+
+	if m.Token != "" {
+		return marathon.StaticToken(m.Token), nil
+	}
+
+	return nil, nil
+}
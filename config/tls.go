@@ -0,0 +1,56 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	ErrBadCAFile   = errors.New("no certificates found in CA file")
+	ErrCertWithKey = errors.New("a client certificate and key must be given together")
+)
+
+// TLS holds the files and options used to build a tls.Config for a client
+type TLS struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	NoVerify   bool
+}
+
+// Config builds a tls.Config that trusts only the CA file instead of the
+// system roots, and presents the client certificate, when they are given
+func (t TLS) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: t.NoVerify,
+		ServerName:         t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrBadCAFile
+		}
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, ErrCertWithKey
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	c, err := TLS{NoVerify: true, ServerName: "consul.example.com"}.Config()
+	assert.Nil(t, err)
+	assert.True(t, c.InsecureSkipVerify)
+	assert.Equal(t, "consul.example.com", c.ServerName)
+	assert.Nil(t, c.RootCAs)
+
+	_, err = TLS{CertFile: "cert.pem"}.Config()
+	assert.Equal(t, ErrCertWithKey, err)
+}
+
+func TestTLSConfigBadCAFile(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "ca")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	_, err = TLS{CAFile: f.Name()}.Config()
+	assert.Equal(t, ErrBadCAFile, err)
+}
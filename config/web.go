@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrBadAdvertise = errors.New("the advertised address must be a URL like http://host:port")
+	ErrNoAdvertise  = errors.New("set --webhook-advertise to where Marathon reaches this process to subscribe to events")
+)
+
+type Web struct {
+	Listen    string
+	Advertise string
+	Subscribe bool
+	Secret    string
+	Auth      string
+	AllowFrom string
+	CertFile  string
+	KeyFile   string
+}
+
+// GetAuth returns the basic auth credentials webhook requests must carry, if
+// any
+func (w Web) GetAuth() (username, password string, err error) {
+	if w.Auth == "" {
+		return "", "", nil
+	}
+
+	creds := strings.SplitN(w.Auth, ":", 2)
+	if len(creds) != 2 {
+		return "", "", ErrBadCredentials
+	}
+
+	return creds[0], creds[1], nil
+}
+
+// AllowedNetworks parses AllowFrom, a comma-separated list of IPs and CIDR
+// blocks. Bare IPs are treated as single-address networks.
+func (w Web) AllowedNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, item := range splitList(w.AllowFrom) {
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// CallbackUrl is the URL Marathon should post events to. It is based on
+// Advertise, which is required: this host's own name is rarely one Marathon
+// can reach, e.g. in a container. It carries the basic auth and shared
+// secret /events requires, since Marathon can't add them by itself.
+func (w Web) CallbackUrl() (string, error) {
+	if w.Advertise == "" {
+		return "", ErrNoAdvertise
+	}
+
+	callback, err := url.Parse(w.Advertise)
+	if err != nil {
+		return "", err
+	}
+	if callback.Scheme == "" || callback.Host == "" {
+		return "", ErrBadAdvertise
+	}
+
+	callback.Path = strings.TrimSuffix(callback.Path, "/") + "/events"
+
+	username, password, err := w.GetAuth()
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		callback.User = url.UserPassword(username, password)
+	}
+
+	if w.Secret != "" {
+		query := callback.Query()
+		query.Set("secret", w.Secret)
+		callback.RawQuery = query.Encode()
+	}
+
+	return callback.String(), nil
+}
@@ -0,0 +1,136 @@
+package consul
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var ErrBadAgentAddress = errors.New("agent address must be a URL with a scheme and a host, e.g. http://{{.Host}}:8500")
+
+// forget an agent once it couldn't be reached this many times in a row, so
+// the agents of decommissioned hosts aren't swept forever
+const agentMaxFailures = 3
+
+// Agents are the Consul agents tasks are registered with: either one central
+// agent, or the agent on each task's host.
+type Agents struct {
+	central Agent
+
+	address *template.Template
+	connect func(address string) (Agent, error)
+
+	lock     sync.Mutex
+	agents   map[string]Agent
+	failures map[string]int
+}
+
+// CentralAgent registers every task with agent
+func CentralAgent(agent Agent) *Agents {
+	return &Agents{central: agent}
+}
+
+// NewLocalAgents registers each task with the agent on its host. address is
+// a template for the agent's URL given the task's Host, like
+// http://{{.Host}}:8500; everything else is taken from config.
+func NewLocalAgents(address string, config *api.Config) (*Agents, error) {
+	tmpl, err := template.New("agent").Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Agents{
+		address: tmpl,
+		connect: func(address string) (Agent, error) {
+			location, err := url.Parse(address)
+			if err != nil || location.Scheme == "" || location.Host == "" {
+				return nil, ErrBadAgentAddress
+			}
+
+			local := *config
+			local.Scheme = location.Scheme
+			local.Address = location.Host
+			return NewAgent(&local)
+		},
+		agents:   map[string]Agent{},
+		failures: map[string]int{},
+	}, nil
+}
+
+// Address returns the address of the agent tasks on host register with. It's
+// empty for the central agent.
+func (a *Agents) Address(host string) (string, error) {
+	if a.central != nil {
+		return "", nil
+	}
+
+	address := &bytes.Buffer{}
+	err := a.address.Execute(address, struct{ Host string }{host})
+	return address.String(), err
+}
+
+// Agent returns the agent at address, connecting to it the first time
+func (a *Agents) Agent(address string) (Agent, error) {
+	if a.central != nil {
+		return a.central, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	agent, ok := a.agents[address]
+	if !ok {
+		var err error
+		agent, err = a.connect(address)
+		if err != nil {
+			return nil, err
+		}
+		a.agents[address] = agent
+	}
+	return agent, nil
+}
+
+// Known lists the address of every agent used so far, in order
+func (a *Agents) Known() []string {
+	if a.central != nil {
+		return []string{""}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	addresses := make([]string, 0, len(a.agents))
+	for address := range a.agents {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// reached records whether the agent at address answered, forgetting it once
+// it hasn't agentMaxFailures times in a row. It's connected to again if a task
+// turns up on its host.
+func (a *Agents) reached(address string, err error) {
+	if a.central != nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err == nil {
+		delete(a.failures, address)
+		return
+	}
+
+	a.failures[address]++
+	if a.failures[address] >= agentMaxFailures {
+		delete(a.agents, address)
+		delete(a.failures, address)
+	}
+}
@@ -0,0 +1,186 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// downAgent is a Consul agent that can't be reached
+type downAgent struct{}
+
+func (downAgent) Services() (map[string]*api.AgentService, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (downAgent) ServiceRegister(*api.AgentServiceRegistration) error {
+	return errors.New("connection refused")
+}
+
+func (downAgent) ServiceDeregister(string) error {
+	return errors.New("connection refused")
+}
+
+// localAgents connects to the agents in running, by address. There's no
+// connecting to any other.
+func localAgents(running map[string]Agent) *Agents {
+	agents, _ := NewLocalAgents("http://{{.Host}}:8500", &api.Config{})
+	agents.connect = func(address string) (Agent, error) {
+		agent, ok := running[address]
+		if !ok {
+			return nil, errors.New("no agent at " + address)
+		}
+		return agent, nil
+	}
+	return agents
+}
+
+func TestLocalAgentsAddress(t *testing.T) {
+	t.Parallel()
+
+	agents, err := NewLocalAgents("https://{{.Host}}:8501", &api.Config{})
+	assert.Nil(t, err)
+	address, err := agents.Address("agent-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://agent-1:8501", address)
+
+	agents, err = NewLocalAgents("{{.Host}}:8500", &api.Config{})
+	assert.Nil(t, err)
+	_, err = agents.Agent("agent-1:8500")
+	assert.Equal(t, ErrBadAgentAddress, err)
+}
+
+func TestSyncTasksLocalAgents(t *testing.T) {
+	t.Parallel()
+
+	running := map[string]Agent{
+		"http://agent-1:8500": mocks.NewAgent(),
+		"http://agent-2:8500": mocks.NewAgent(),
+	}
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = localAgents(running)
+
+	first := portedTask("web.1")
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{first}))
+
+	services, _ := running["http://agent-1:8500"].Services()
+	assert.Len(t, services, 2)
+	services, _ = running["http://agent-2:8500"].Services()
+	assert.Len(t, services, 0)
+
+	// the task moves, and we restarted in the meantime: its old agent is
+	// only known from the stored task
+	consul.Agents = localAgents(running)
+	second := portedTask("web.2")
+	second.Host = "agent-2"
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{second}))
+
+	services, _ = running["http://agent-1:8500"].Services()
+	assert.Len(t, services, 0)
+	services, _ = running["http://agent-2:8500"].Services()
+	assert.Len(t, services, 2)
+	assert.Equal(t, "agent-2", services["marathon:web.2:http"].Address)
+}
+
+func TestLocalAgentsBadTemplate(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewLocalAgents("http://{{.Host:8500", &api.Config{})
+	assert.NotNil(t, err)
+
+	agents, err := NewLocalAgents("http://{{.Hostname}}:8500", &api.Config{})
+	assert.Nil(t, err)
+	_, err = agents.Address("agent-1")
+	assert.NotNil(t, err)
+}
+
+func TestSyncTasksAgentDown(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = localAgents(map[string]Agent{"http://agent-1:8500": downAgent{}})
+
+	// test!
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	err := consul.SyncTasks(portedApp.ID, []*tasks.Task{portedTask("web.1")})
+	assert.NotNil(t, err)
+
+	// the task is stored all the same
+	pair, _, _ := kv.Get("marathon/web/tasks/web.1")
+	assert.NotNil(t, pair)
+
+	// and once it has been down for a while, the agent is no longer swept
+	assert.Equal(t, []string{"http://agent-1:8500"}, consul.Agents.Known())
+	for i := 0; i < agentMaxFailures; i++ {
+		assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	}
+	assert.Len(t, consul.Agents.Known(), 0)
+}
+
+func TestSyncTasksOldAgentDown(t *testing.T) {
+	t.Parallel()
+
+	running := map[string]Agent{
+		"http://agent-1:8500": mocks.NewAgent(),
+		"http://agent-2:8500": mocks.NewAgent(),
+	}
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = localAgents(running)
+
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{portedTask("web.1")}))
+
+	// the task moves while its old host goes down
+	running["http://agent-1:8500"] = downAgent{}
+	consul.Agents = localAgents(running)
+	moved := portedTask("web.2")
+	moved.Host = "agent-2"
+
+	// test!
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{moved}))
+	assert.Nil(t, consul.UpdateTask(moved))
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+
+	services, _ := running["http://agent-2:8500"].Services()
+	assert.Len(t, services, 2)
+}
+
+func TestSyncTasksNoAgent(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = localAgents(map[string]Agent{})
+
+	// test!
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	err := consul.SyncTasks(portedApp.ID, []*tasks.Task{portedTask("web.1")})
+	assert.Equal(t, Errors{errors.New("no agent at http://agent-1:8500")}, err)
+	assert.Len(t, consul.Agents.Known(), 0)
+
+	// nothing to register, nothing to fail
+	assert.Nil(t, consul.DeleteTask(portedTask("web.1")))
+}
+
+func TestDeleteTaskAgentDown(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = CentralAgent(downAgent{})
+	kv.Put(&api.KVPair{Key: "marathon/web/tasks/web.1", Value: portedTask("web.1").KV().Value})
+
+	// test!
+	assert.Nil(t, consul.DeleteTask(portedTask("web.1")))
+	pair, _, _ := kv.Get("marathon/web/tasks/web.1")
+	assert.Nil(t, pair)
+}
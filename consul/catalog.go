@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var ErrNoInstances = errors.New("no healthy instances found")
+
+// Catalog looks up services registered in Consul
+type Catalog struct {
+	health       *api.Health
+	QueryOptions *api.QueryOptions
+}
+
+func NewCatalog(config *api.Config) (*Catalog, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := &Catalog{
+		health:       client.Health(),
+		QueryOptions: &api.QueryOptions{},
+	}
+
+	return catalog, nil
+}
+
+// Resolve returns the host:port of every instance of service that passes its
+// health checks
+func (c Catalog) Resolve(service string) ([]string, error) {
+	entries, _, err := c.health.Service(service, "", true, c.QueryOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: %s", service, ErrNoInstances)
+	}
+
+	locations := make([]string, len(entries))
+	for i, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		locations[i] = fmt.Sprintf("%s:%d", address, entry.Service.Port)
+	}
+
+	return locations, nil
+}
@@ -0,0 +1,35 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogResolve(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/marathon", r.URL.Path)
+		fmt.Fprintln(w, `[
+			{"Node": {"Node": "a", "Address": "10.0.0.1"}, "Service": {"Service": "marathon", "Port": 8080}},
+			{"Node": {"Node": "b", "Address": "10.0.0.2"}, "Service": {"Service": "marathon", "Address": "172.16.0.2", "Port": 8081}}
+		]`)
+	}))
+	defer server.Close()
+
+	catalog, err := NewCatalog(&api.Config{
+		Address: strings.TrimPrefix(server.URL, "http://"),
+		Scheme:  "http",
+	})
+	assert.Nil(t, err)
+
+	locations, err := catalog.Resolve("marathon")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "172.16.0.2:8081"}, locations)
+}
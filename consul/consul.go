@@ -6,18 +6,36 @@ import (
 	"fmt"
 	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/CiscoCloud/marathon-consul/tasks"
+	"github.com/CiscoCloud/marathon-consul/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Consul struct {
 	kv         KVer
 	AppsPrefix string
+	// Writer applies the writes of a sync. If nil, they are applied one at
+	// a time.
+	Writer *Writer
+	// TombstoneRetention, if set, moves removed tasks to a tombstone under
+	// <app>/terminated instead of deleting them outright, for this long
+	TombstoneRetention time.Duration
+	// AppEncoding is how apps are serialized, Typed if unset
+	AppEncoding apps.Encoding
+	// Agents, if set, register a service per registered port of each task
+	// (see apps.Service)
+	Agents *Agents
 }
 
 func NewConsul(kv KVer, prefix string) Consul {
-	return Consul{kv, prefix}
+	return Consul{kv: kv, AppsPrefix: prefix}
 }
 
+var _ Store = &Consul{}
+
 // SyncApps takes a *complete* list of apps from Marathon and compares them
 // against the apps in Consul. It performs any necessary updates, then
 // recursively deletes any apps that are present in Consul but not the given
@@ -28,7 +46,8 @@ func (consul *Consul) SyncApps(apps []*apps.App) error {
 		return err
 	}
 	remotePairs := MapKVPairs(remoteKeys)
-	localPairs := MapApps(apps)
+	localPairs := MapApps(apps, consul.AppEncoding)
+	writes := []func() error{}
 
 	// add/update any new apps
 	for _, local := range localPairs {
@@ -37,10 +56,7 @@ func (consul *Consul) SyncApps(apps []*apps.App) error {
 
 		remote, exists := remotePairs[local.Key]
 		if !exists || !bytes.Equal(local.Value, remote.Value) {
-			_, err := consul.kv.Put(local)
-			if err != nil {
-				return err
-			}
+			writes = append(writes, consul.put(local))
 		}
 	}
 
@@ -50,36 +66,55 @@ func (consul *Consul) SyncApps(apps []*apps.App) error {
 		if strings.Contains(remote.Key, "tasks") {
 			continue
 		}
+		// nor with version history, which is kept in SyncAppVersions
+		if strings.Contains(remote.Key, "/versions/") {
+			continue
+		}
+		// nor with tombstones, which go away once their retention is over
+		// or along with their app
+		if strings.Contains(remote.Key, "/terminated/") {
+			continue
+		}
+		// neither do we touch pods and the like, which live in their own
+		// subtrees
+		if isReserved(consul.AppsPrefix, remote.Key) {
+			continue
+		}
 
 		if _, exists := localPairs[WithoutPrefix(consul.AppsPrefix, remote.Key)]; !exists {
-			_, err := consul.kv.Delete(remote.Key)
-			if err != nil {
-				return err
-			}
+			writes = append(writes, consul.deleteTree(remote.Key))
+		}
+	}
 
-			// delete tasks
-			appTasks, _, err := consul.kv.List(remote.Key)
-			if err != nil {
-				return err
-			}
+	err = consul.Writer.Apply(writes)
+	if err != nil {
+		return err
+	}
 
-			for _, task := range appTasks {
-				_, err := consul.kv.Delete(task.Key)
-				if err != nil {
-					return err
-				}
+	// deregister the tasks of apps that are gone, wherever they ran
+	known := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		known[app.ID] = true
+	}
+	gone := api.KVPairs{}
+	for _, remote := range remoteKeys {
+		key := WithoutPrefix(consul.AppsPrefix, remote.Key)
+		if i := strings.Index(key, "/tasks/"); i >= 0 {
+			if _, exists := localPairs[key[:i]]; !exists {
+				gone = append(gone, remote)
 			}
 		}
 	}
-
-	return nil
+	return consul.syncServices(true, taskHosts(gone), func(remote *api.AgentService) bool {
+		return !known[remote.Meta[MetaApp]]
+	}, nil)
 }
 
 // UpdateApp takes an App and updates it in Consul
 func (consul *Consul) UpdateApp(app *apps.App) error {
 	var err error = nil
 
-	local := app.KV()
+	local := app.EncodedKV(consul.AppEncoding)
 	local.Key = WithPrefix(consul.AppsPrefix, local.Key)
 
 	remote, _, err := consul.kv.Get(local.Key)
@@ -94,30 +129,84 @@ func (consul *Consul) UpdateApp(app *apps.App) error {
 	return err
 }
 
-// DeleteApp takes an App and deletes it from Consul
+// SyncAppVersions takes the definitions of an app to keep as its history and
+// compares them against the ones in Consul. It performs any necessary
+// updates, then deletes any definitions that are present in Consul but not
+// the list.
+func (consul *Consul) SyncAppVersions(appId string, versions []*apps.App) error {
+	app := &apps.App{ID: appId}
+
+	locals := make([]*api.KVPair, len(versions))
+	for i, version := range versions {
+		locals[i] = version.VersionKV(consul.AppEncoding)
+	}
+
+	return consul.syncSubtree(app.VersionsKey(), locals)
+}
+
+// TrimAppVersions deletes all but the latest count definitions kept as the
+// app's history, for syncs that can't fetch the history to sync or don't
+// keep one anymore
+func (consul *Consul) TrimAppVersions(appId string, count int) error {
+	app := &apps.App{ID: appId}
+	stored, _, err := consul.kv.List(WithPrefix(consul.AppsPrefix, app.VersionsKey()+"/"))
+	if err != nil {
+		return err
+	}
+
+	// versions are timestamps, so the latest sort first in reverse
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Key > stored[j].Key })
+	writes := []func() error{}
+	for i := count; i < len(stored); i++ {
+		writes = append(writes, consul.delete(stored[i].Key))
+	}
+
+	return consul.Writer.Apply(writes)
+}
+
+// DeleteApp takes an App and deletes it from Consul, deregistering its tasks
 func (consul *Consul) DeleteApp(app *apps.App) error {
 	_, err := consul.kv.Delete(WithPrefix(consul.AppsPrefix, app.Key()))
-	return err
-}
+	if err != nil || consul.Agents == nil {
+		return err
+	}
 
-// SyncTasks takes a *complete* list of tasks from a Marathon App and compares
-// them against the tasks in Consul. It performs any necessary updates, then
-// deletes any tasks that are present in Consul but not the list.
-func (consul *Consul) SyncTasks(appId string, tasks []*tasks.Task) error {
-	// remove prefix from app ID if present
-	if appId[0] == '/' {
-		appId = appId[1:]
+	stored, _, err := consul.kv.List(WithPrefix(consul.AppsPrefix, app.Key()+"/tasks/"))
+	if err != nil {
+		return err
 	}
+	return consul.syncServices(false, taskHosts(stored), ofApps(app.ID), nil)
+}
 
+// SyncTasks takes a *complete* list of tasks from a Marathon App and compares
+// them against the tasks in Consul. It performs any necessary updates, keeping
+// what the stored tasks know (see Task.Resync), then deletes any tasks that
+// are present in Consul but not the list.
+func (consul *Consul) SyncTasks(appId string, taskList []*tasks.Task) error {
 	remoteKeys, _, err := consul.kv.List(fmt.Sprintf(
-		"%s/%s/tasks", consul.AppsPrefix, appId,
+		"%s/%s/tasks/", consul.AppsPrefix, utils.CleanID(appId),
 	))
 	if err != nil {
 		return err
 	}
 
 	remotePairs := MapKVPairs(remoteKeys)
-	localPairs := MapTasks(tasks)
+
+	// keep what the stored tasks know and Marathon doesn't, like marks
+	merged := make([]*tasks.Task, len(taskList))
+	for i, task := range taskList {
+		local := *task
+		if remote, exists := remotePairs[WithPrefix(consul.AppsPrefix, task.Key())]; exists {
+			stored, err := tasks.ParseTask(remote.Value)
+			if err == nil && stored.ID == task.ID {
+				local.Resync(stored)
+			}
+		}
+		merged[i] = &local
+	}
+
+	localPairs := MapTasks(merged)
+	writes := []func() error{}
 
 	// add/update any new tasks
 	for _, local := range localPairs {
@@ -126,38 +215,289 @@ func (consul *Consul) SyncTasks(appId string, tasks []*tasks.Task) error {
 
 		remote, exists := remotePairs[local.Key]
 		if !exists || !bytes.Equal(local.Value, remote.Value) {
-			_, err := consul.kv.Put(local)
-			if err != nil {
-				return err
-			}
+			writes = append(writes, consul.put(local))
 		}
 	}
 
-	// remove any outdated tasks
+	// remove any outdated tasks, leaving tombstones if asked to
 	for _, remote := range remotePairs {
 		if _, exists := localPairs[WithoutPrefix(consul.AppsPrefix, remote.Key)]; !exists {
-			_, err := consul.kv.Delete(remote.Key)
-			if err != nil {
-				return err
-			}
+			writes = append(writes, consul.bury(remote))
 		}
 	}
 
-	return nil
+	err = consul.Writer.Apply(writes)
+	if err != nil || consul.Agents == nil {
+		return err
+	}
+
+	// and the same with their services, wherever they ran before
+	service, err := consul.appService(appId)
+	if err != nil {
+		return err
+	}
+	registrations := map[string][]*api.AgentServiceRegistration{}
+	for _, task := range merged {
+		registrations[task.Host] = append(registrations[task.Host], Registrations(service, task)...)
+	}
+	return consul.syncServices(false, taskHosts(remoteKeys), ofApps(appId), registrations)
 }
 
-// UpdateTask takes a Task and updates it in Consul
+// UpdateTask takes a Task and updates it in Consul, keeping what the stored
+// record knows and the Task doesn't (see Task.Preserve)
 func (consul *Consul) UpdateTask(task *tasks.Task) error {
-	local := task.KV()
-	local.Key = WithPrefix(consul.AppsPrefix, local.Key)
+	key := WithPrefix(consul.AppsPrefix, task.Key())
+
+	remote, _, err := consul.kv.Get(key)
+	if err != nil {
+		return err
+	}
+
+	merged := *task
+	hosts := []string{}
+	if remote != nil {
+		stored, err := tasks.ParseTask(remote.Value)
+		if err == nil && stored.ID == task.ID {
+			merged.Preserve(stored)
+			hosts = append(hosts, stored.Host)
+		}
+	}
+
+	local := merged.KV()
+	local.Key = key
 
 	// we always want to update tasks
+	_, err = consul.kv.Put(local)
+	if err != nil || consul.Agents == nil {
+		return err
+	}
+
+	service, err := consul.appService(task.AppID)
+	if err != nil {
+		return err
+	}
+	return consul.syncServices(false, hosts, ofTask(task.ID), map[string][]*api.AgentServiceRegistration{
+		merged.Host: Registrations(service, &merged),
+	})
+}
+
+// DeleteTask taske a Task, deletes it from Consul and deregisters it. With a
+// tombstone retention, the stored task is kept as a tombstone, updated with
+// the Task's final status. Deregistering is best effort: it's logged when it
+// fails, and the next sync tries again.
+func (consul *Consul) DeleteTask(task *tasks.Task) error {
+	err := consul.deleteTask(task)
+	if err != nil {
+		return err
+	}
+
+	err = consul.syncServices(false, []string{task.Host}, ofTask(task.ID), nil)
+	if err != nil {
+		log.WithError(err).WithField("task", task.ID).Warn("couldn't deregister deleted task")
+	}
+	return nil
+}
+
+// deleteTask is DeleteTask without deregistering the task
+func (consul *Consul) deleteTask(task *tasks.Task) error {
+	key := WithPrefix(consul.AppsPrefix, task.Key())
+	if consul.TombstoneRetention == 0 {
+		_, err := consul.kv.Delete(key)
+		return err
+	}
+
+	remote, _, err := consul.kv.Get(key)
+	if err != nil {
+		return err
+	}
+
+	tombstone := *task
+	if remote != nil {
+		stored, err := tasks.ParseTask(remote.Value)
+		if err == nil && stored.ID == task.ID {
+			tombstone.Preserve(stored)
+		}
+	}
+
+	return consul.entomb(key, &tombstone)
+}
+
+// ExpireTombstones deletes every tombstone left before cutoff
+func (consul *Consul) ExpireTombstones(cutoff time.Time) error {
+	remoteKeys, _, err := consul.kv.List(consul.AppsPrefix)
+	if err != nil {
+		return err
+	}
+
+	writes := []func() error{}
+	for _, remote := range remoteKeys {
+		if !strings.Contains(remote.Key, "/terminated/") || isReserved(consul.AppsPrefix, remote.Key) {
+			continue
+		}
+
+		task, err := tasks.ParseTask(remote.Value)
+		if err != nil || task.TerminatedBefore(cutoff) {
+			writes = append(writes, consul.delete(remote.Key))
+		}
+	}
+
+	return consul.Writer.Apply(writes)
+}
+
+// bury returns a write removing the stored task remote, for a Writer. With a
+// tombstone retention, the task is kept as a tombstone as it was last seen.
+func (consul *Consul) bury(remote *api.KVPair) func() error {
+	if consul.TombstoneRetention == 0 {
+		return consul.delete(remote.Key)
+	}
+
+	return func() error {
+		task, err := tasks.ParseTask(remote.Value)
+		if err != nil || task.ID == "" {
+			_, err := consul.kv.Delete(remote.Key)
+			return err
+		}
+		return consul.entomb(remote.Key, task)
+	}
+}
+
+// entomb writes task's tombstone, then deletes the task at key
+func (consul *Consul) entomb(key string, task *tasks.Task) error {
+	task.MarkedAt = ""
+	task.Terminate(time.Now())
+
+	local := task.KV()
+	local.Key = WithPrefix(consul.AppsPrefix, task.TombstoneKey())
 	_, err := consul.kv.Put(local)
+	if err != nil {
+		return err
+	}
+
+	_, err = consul.kv.Delete(key)
 	return err
 }
 
-// DeleteTask taske a Task and deletes it from Consul
-func (consul *Consul) DeleteTask(task *tasks.Task) error {
-	_, err := consul.kv.Delete(WithPrefix(consul.AppsPrefix, task.Key()))
+// ExpireTasks removes every task that was marked before cutoff like
+// DeleteTask does: leaving a tombstone with a tombstone retention, and
+// deregistering it on a best effort basis.
+func (consul *Consul) ExpireTasks(cutoff time.Time) error {
+	remoteKeys, _, err := consul.kv.List(consul.AppsPrefix)
+	if err != nil {
+		return err
+	}
+
+	writes := []func() error{}
+	expired := []*tasks.Task{}
+	for _, remote := range remoteKeys {
+		if !strings.Contains(remote.Key, "/tasks/") || isReserved(consul.AppsPrefix, remote.Key) {
+			continue
+		}
+
+		task, err := tasks.ParseTask(remote.Value)
+		if err == nil && task.MarkedBefore(cutoff) {
+			writes = append(writes, consul.bury(remote))
+			expired = append(expired, task)
+		}
+	}
+
+	err = consul.Writer.Apply(writes)
+	if err != nil || consul.Agents == nil {
+		return err
+	}
+
+	for _, task := range expired {
+		err = consul.syncServices(false, []string{task.Host}, ofTask(task.ID), nil)
+		if err != nil {
+			log.WithError(err).WithField("task", task.ID).Warn("couldn't deregister expired task")
+		}
+	}
+	return nil
+}
+
+// syncSubtree makes the keys directly below subtree exactly locals: it
+// performs any necessary updates, then deletes any keys that are present in
+// Consul but not in locals.
+func (consul *Consul) syncSubtree(subtree string, locals []*api.KVPair) error {
+	remoteKeys, _, err := consul.kv.List(WithPrefix(consul.AppsPrefix, subtree+"/"))
+	if err != nil {
+		return err
+	}
+	remotePairs := MapKVPairs(remoteKeys)
+
+	localPairs := make(map[string]*api.KVPair, len(locals))
+	writes := []func() error{}
+	for _, local := range locals {
+		local.Key = WithPrefix(consul.AppsPrefix, local.Key)
+		localPairs[local.Key] = local
+
+		remote, exists := remotePairs[local.Key]
+		if !exists || !bytes.Equal(local.Value, remote.Value) {
+			writes = append(writes, consul.put(local))
+		}
+	}
+
+	for _, remote := range remotePairs {
+		if _, exists := localPairs[remote.Key]; !exists {
+			writes = append(writes, consul.delete(remote.Key))
+		}
+	}
+
+	return consul.Writer.Apply(writes)
+}
+
+// putIfChanged stores local under the prefix, unless it is stored already
+func (consul *Consul) putIfChanged(local *api.KVPair) error {
+	local.Key = WithPrefix(consul.AppsPrefix, local.Key)
+
+	remote, _, err := consul.kv.Get(local.Key)
+	if err != nil {
+		return err
+	}
+
+	if remote == nil || !bytes.Equal(local.Value, remote.Value) {
+		_, err = consul.kv.Put(local)
+	}
+
 	return err
 }
+
+// put returns a write storing pair, for a Writer
+func (consul *Consul) put(pair *api.KVPair) func() error {
+	return func() error {
+		_, err := consul.kv.Put(pair)
+		return err
+	}
+}
+
+// delete returns a write deleting key, for a Writer
+func (consul *Consul) delete(key string) func() error {
+	return func() error {
+		_, err := consul.kv.Delete(key)
+		return err
+	}
+}
+
+// deleteTree returns a write deleting key and everything below it, for a
+// Writer
+func (consul *Consul) deleteTree(key string) func() error {
+	return func() error {
+		_, err := consul.kv.Delete(key)
+		if err != nil {
+			return err
+		}
+
+		children, _, err := consul.kv.List(key + "/")
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			_, err := consul.kv.Delete(child.Key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -2,12 +2,14 @@ package consul
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/CiscoCloud/marathon-consul/mocks"
 	"github.com/CiscoCloud/marathon-consul/tasks"
 	"github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 var (
@@ -32,7 +34,7 @@ func TestSyncApps(t *testing.T) {
 	kv.Put(testAppKVTask)
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.SyncApps([]*apps.App{testApp})
 	assert.Nil(t, err)
 
@@ -61,7 +63,7 @@ func TestUpdateApp(t *testing.T) {
 	kv.Put(oldAppKV)
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.UpdateApp(testApp)
 	assert.Nil(t, err)
 
@@ -80,7 +82,7 @@ func TestDeleteApp(t *testing.T) {
 	kv.Put(oldAppKV)
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.DeleteApp(testApp)
 	assert.Nil(t, err)
 
@@ -103,7 +105,7 @@ func TestSyncTasks(t *testing.T) {
 	tasks := []*tasks.Task{testTask}
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.SyncTasks(testApp.ID, tasks)
 	assert.Nil(t, err)
 
@@ -130,7 +132,7 @@ func TestUpdateTask(t *testing.T) {
 	kv.Put(oldTaskKV)
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.UpdateTask(testTask)
 	assert.Nil(t, err)
 
@@ -146,7 +148,7 @@ func TestCreateTask(t *testing.T) {
 	kv := mocks.NewKVer()
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.UpdateTask(testTask)
 	assert.Nil(t, err)
 
@@ -167,7 +169,7 @@ func TestDeleteTask(t *testing.T) {
 	kv.Put(oldTaskKV)
 
 	// test!
-	consul := Consul{kv, appPrefix}
+	consul := NewConsul(kv, appPrefix)
 	err := consul.DeleteTask(testTask)
 	assert.Nil(t, err)
 
@@ -176,3 +178,221 @@ func TestDeleteTask(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Nil(t, newTaskKV)
 }
+
+func TestUpdateTaskPreserves(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	stored := &tasks.Task{ID: "testTask", AppID: "testApp", StartedAt: "2015-06-24T14:57:06.466Z"}
+	err := consul.UpdateTask(stored)
+	assert.Nil(t, err)
+
+	// test!
+	err = consul.UpdateTask(&tasks.Task{ID: "testTask", AppID: "testApp", TaskStatus: "TASK_RUNNING"})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/testTask")
+	assert.Nil(t, err)
+	updated, err := tasks.ParseTask(result.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "TASK_RUNNING", updated.TaskStatus)
+	assert.Equal(t, stored.StartedAt, updated.StartedAt)
+}
+
+func TestSyncTasksKeepsMarks(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	marked := &tasks.Task{ID: "testTask", AppID: "testApp", TaskStatus: "TASK_UNREACHABLE"}
+	marked.Mark(time.Now().Add(-time.Hour))
+	assert.Nil(t, consul.UpdateTask(marked))
+
+	// test!
+	listed := &tasks.Task{ID: "testTask", AppID: "testApp", TaskStatus: "TASK_UNREACHABLE"}
+	assert.Nil(t, consul.SyncTasks("testApp", []*tasks.Task{listed}))
+
+	result, _, err := kv.Get("marathon/testApp/tasks/testTask")
+	assert.Nil(t, err)
+	synced, err := tasks.ParseTask(result.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, marked.MarkedAt, synced.MarkedAt)
+
+	// so it still expires
+	assert.Nil(t, consul.ExpireTasks(time.Now()))
+	result, _, _ = kv.Get("marathon/testApp/tasks/testTask")
+	assert.Nil(t, result)
+}
+
+func TestExpireTasks(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	now := time.Now()
+
+	expired := &tasks.Task{ID: "expired", AppID: "testApp"}
+	expired.Mark(now.Add(-time.Hour))
+	recent := &tasks.Task{ID: "recent", AppID: "testApp"}
+	recent.Mark(now)
+	for _, task := range []*tasks.Task{expired, recent, testTask} {
+		assert.Nil(t, consul.UpdateTask(task))
+	}
+
+	// test!
+	err := consul.ExpireTasks(now.Add(-time.Minute))
+	assert.Nil(t, err)
+
+	remaining, _, err := kv.List("marathon/testApp/tasks/")
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 2)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/expired")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
+
+func TestExpireTasksTombstone(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.TombstoneRetention = time.Hour
+	expired := &tasks.Task{ID: "expired", AppID: "testApp", TaskStatus: "TASK_UNREACHABLE"}
+	expired.Mark(time.Now().Add(-time.Hour))
+	assert.Nil(t, consul.UpdateTask(expired))
+
+	// test!
+	err := consul.ExpireTasks(time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/expired")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, _, err = kv.Get("marathon/testApp/terminated/expired")
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		tombstone, err := tasks.ParseTask(result.Value)
+		assert.Nil(t, err)
+		assert.Equal(t, "TASK_UNREACHABLE", tombstone.TaskStatus)
+		assert.NotEqual(t, "", tombstone.TerminatedAt)
+	}
+}
+
+func TestDeleteTaskTombstone(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.TombstoneRetention = time.Hour
+	stored := &tasks.Task{ID: "testTask", AppID: "testApp", Host: "test", StartedAt: "2015-06-24T14:57:06.466Z"}
+	assert.Nil(t, consul.UpdateTask(stored))
+
+	// test!
+	err := consul.DeleteTask(&tasks.Task{ID: "testTask", AppID: "testApp", TaskStatus: "TASK_KILLED"})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/testTask")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, _, err = kv.Get("marathon/testApp/terminated/testTask")
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		tombstone, err := tasks.ParseTask(result.Value)
+		assert.Nil(t, err)
+		assert.Equal(t, "TASK_KILLED", tombstone.TaskStatus)
+		assert.Equal(t, stored.StartedAt, tombstone.StartedAt)
+		assert.NotEqual(t, "", tombstone.TerminatedAt)
+	}
+
+	// syncing the app leaves its tombstones alone
+	err = consul.SyncApps([]*apps.App{testApp})
+	assert.Nil(t, err)
+
+	result, _, err = kv.Get("marathon/testApp/terminated/testTask")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+}
+
+func TestSyncTasksTombstone(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.TombstoneRetention = time.Hour
+	gone := &tasks.Task{ID: "gone", AppID: "testApp", TaskStatus: "TASK_RUNNING"}
+	assert.Nil(t, consul.UpdateTask(gone))
+
+	// test!
+	err := consul.SyncTasks(testApp.ID, []*tasks.Task{testTask})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/gone")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, _, err = kv.Get("marathon/testApp/terminated/gone")
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		tombstone, err := tasks.ParseTask(result.Value)
+		assert.Nil(t, err)
+		assert.Equal(t, gone.TaskStatus, tombstone.TaskStatus)
+		assert.NotEqual(t, "", tombstone.TerminatedAt)
+	}
+}
+
+func TestExpireTombstones(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	now := time.Now()
+
+	expired := &tasks.Task{ID: "expired", AppID: "testApp"}
+	expired.Terminate(now.Add(-time.Hour))
+	recent := &tasks.Task{ID: "recent", AppID: "testApp"}
+	recent.Terminate(now)
+	for _, task := range []*tasks.Task{expired, recent} {
+		pair := task.KV()
+		pair.Key = WithPrefix(appPrefix, task.TombstoneKey())
+		kv.Put(pair)
+	}
+	assert.Nil(t, consul.UpdateTask(testTask))
+
+	// test!
+	err := consul.ExpireTombstones(now.Add(-time.Minute))
+	assert.Nil(t, err)
+
+	remaining, _, err := kv.List("marathon/testApp/terminated/")
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 1)
+
+	result, _, err := kv.Get("marathon/testApp/tasks/testTask")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+}
+
+func TestSyncAppsRaw(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	consul.AppEncoding = apps.Raw
+
+	blob := []byte(`{"id": "/testApp", "someFutureField": true}`)
+	app := &apps.App{}
+	assert.Nil(t, json.Unmarshal(blob, app))
+
+	// test!
+	err := consul.SyncApps([]*apps.App{app})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/testApp")
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, blob, result.Value)
+	}
+}
@@ -0,0 +1,29 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/hashicorp/consul/api"
+)
+
+// SyncDeployments takes a *complete* list of deployments in progress and
+// makes the deployments subtree match it, removing deployments that have
+// finished.
+func (consul *Consul) SyncDeployments(deploymentList []*deployments.Deployment) error {
+	locals := make([]*api.KVPair, len(deploymentList))
+	for i, deployment := range deploymentList {
+		locals[i] = deployment.KV()
+	}
+
+	return consul.syncSubtree(deployments.KeyPrefix, locals)
+}
+
+// UpdateDeployment takes a Deployment and updates it in Consul
+func (consul *Consul) UpdateDeployment(deployment *deployments.Deployment) error {
+	return consul.putIfChanged(deployment.KV())
+}
+
+// DeleteDeployment takes a Deployment and deletes it from Consul
+func (consul *Consul) DeleteDeployment(deployment *deployments.Deployment) error {
+	_, err := consul.kv.Delete(WithPrefix(consul.AppsPrefix, deployment.Key()))
+	return err
+}
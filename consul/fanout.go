@@ -0,0 +1,490 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fanout mirrors every write to several Targets. Each Target applies and
+// retries its writes independently, so an outage in one datacenter does not
+// hold up updates to the others.
+type Fanout struct {
+	Targets []*Target
+}
+
+// NewFanout starts a worker for every target and returns a Fanout that
+// writes to all of them.
+func NewFanout(targets ...*Target) *Fanout {
+	for _, target := range targets {
+		go target.run()
+	}
+
+	return &Fanout{targets}
+}
+
+// enqueue queues an operation on every target. Operations with a key, like
+// syncs, replace the operation with the same key that's still queued. The
+// error lists the targets that didn't take the operation; how the operations
+// they took went is up to Status.
+func (f *Fanout) enqueue(name, key string, apply func(*Consul) error) error {
+	errs := Errors{}
+	for _, target := range f.Targets {
+		err := target.enqueue(operation{name: name, key: key, apply: apply, queued: time.Now()})
+		if err != nil {
+			errs = append(errs, &TargetError{target.Name, err})
+		}
+	}
+	return errs.err()
+}
+
+// SyncApps queues a SyncApps on every target
+func (f *Fanout) SyncApps(apps []*apps.App) error {
+	return f.enqueue("sync apps", "sync apps", func(c *Consul) error { return c.SyncApps(apps) })
+}
+
+// UpdateApp queues an UpdateApp on every target
+func (f *Fanout) UpdateApp(app *apps.App) error {
+	return f.enqueue("update app", "", func(c *Consul) error { return c.UpdateApp(app) })
+}
+
+// DeleteApp queues a DeleteApp on every target
+func (f *Fanout) DeleteApp(app *apps.App) error {
+	return f.enqueue("delete app", "", func(c *Consul) error { return c.DeleteApp(app) })
+}
+
+// SyncAppVersions queues a SyncAppVersions on every target
+func (f *Fanout) SyncAppVersions(appId string, versions []*apps.App) error {
+	return f.enqueue("sync app versions", "sync app versions "+appId, func(c *Consul) error { return c.SyncAppVersions(appId, versions) })
+}
+
+// TrimAppVersions queues a TrimAppVersions on every target
+func (f *Fanout) TrimAppVersions(appId string, count int) error {
+	return f.enqueue("trim app versions", "trim app versions "+appId, func(c *Consul) error { return c.TrimAppVersions(appId, count) })
+}
+
+// SyncTasks queues a SyncTasks on every target
+func (f *Fanout) SyncTasks(appId string, tasks []*tasks.Task) error {
+	return f.enqueue("sync tasks", "sync tasks "+appId, func(c *Consul) error { return c.SyncTasks(appId, tasks) })
+}
+
+// UpdateTask queues an UpdateTask on every target
+func (f *Fanout) UpdateTask(task *tasks.Task) error {
+	return f.enqueue("update task", "", func(c *Consul) error { return c.UpdateTask(task) })
+}
+
+// DeleteTask queues a DeleteTask on every target
+func (f *Fanout) DeleteTask(task *tasks.Task) error {
+	return f.enqueue("delete task", "", func(c *Consul) error { return c.DeleteTask(task) })
+}
+
+// ExpireTasks queues an ExpireTasks on every target
+func (f *Fanout) ExpireTasks(cutoff time.Time) error {
+	return f.enqueue("expire tasks", "expire tasks", func(c *Consul) error { return c.ExpireTasks(cutoff) })
+}
+
+// ExpireTombstones queues an ExpireTombstones on every target
+func (f *Fanout) ExpireTombstones(cutoff time.Time) error {
+	return f.enqueue("expire tombstones", "expire tombstones", func(c *Consul) error { return c.ExpireTombstones(cutoff) })
+}
+
+// SyncPods queues a SyncPods on every target
+func (f *Fanout) SyncPods(podList []*pods.Pod) error {
+	return f.enqueue("sync pods", "sync pods", func(c *Consul) error { return c.SyncPods(podList) })
+}
+
+// UpdatePod queues an UpdatePod on every target
+func (f *Fanout) UpdatePod(pod *pods.Pod) error {
+	return f.enqueue("update pod", "", func(c *Consul) error { return c.UpdatePod(pod) })
+}
+
+// DeletePod queues a DeletePod on every target
+func (f *Fanout) DeletePod(pod *pods.Pod) error {
+	return f.enqueue("delete pod", "", func(c *Consul) error { return c.DeletePod(pod) })
+}
+
+// SyncPodInstances queues a SyncPodInstances on every target
+func (f *Fanout) SyncPodInstances(podId string, instances []*pods.Instance) error {
+	return f.enqueue("sync pod instances", "sync pod instances "+podId, func(c *Consul) error { return c.SyncPodInstances(podId, instances) })
+}
+
+// SyncDeployments queues a SyncDeployments on every target
+func (f *Fanout) SyncDeployments(deploymentList []*deployments.Deployment) error {
+	return f.enqueue("sync deployments", "sync deployments", func(c *Consul) error { return c.SyncDeployments(deploymentList) })
+}
+
+// UpdateDeployment queues an UpdateDeployment on every target
+func (f *Fanout) UpdateDeployment(deployment *deployments.Deployment) error {
+	return f.enqueue("update deployment", "", func(c *Consul) error { return c.UpdateDeployment(deployment) })
+}
+
+// DeleteDeployment queues a DeleteDeployment on every target
+func (f *Fanout) DeleteDeployment(deployment *deployments.Deployment) error {
+	return f.enqueue("delete deployment", "", func(c *Consul) error { return c.DeleteDeployment(deployment) })
+}
+
+// SyncGroups queues a SyncGroups on every target
+func (f *Fanout) SyncGroups(groupList []*groups.Group) error {
+	return f.enqueue("sync groups", "sync groups", func(c *Consul) error { return c.SyncGroups(groupList) })
+}
+
+// Drain stops accepting writes and waits until every target has applied the
+// writes it has queued, or until ctx is done. Operations that could not be
+// applied in time are reported in the error.
+func (f *Fanout) Drain(ctx context.Context) error {
+	for _, target := range f.Targets {
+		target.close()
+	}
+
+	undelivered := 0
+	for _, target := range f.Targets {
+		select {
+		case <-target.done:
+		case <-ctx.Done():
+			pending := target.pending()
+			undelivered += pending
+			target.logger().WithField("pending", pending).Error("gave up draining target")
+		}
+	}
+
+	if undelivered > 0 {
+		return fmt.Errorf("%d operations were not applied before the deadline", undelivered)
+	}
+	return nil
+}
+
+// Status reports the state of every target
+func (f *Fanout) Status() interface{} {
+	statuses := make([]TargetStatus, len(f.Targets))
+	for i, target := range f.Targets {
+		statuses[i] = target.Status()
+	}
+	return statuses
+}
+
+// Fanout is a Store too, so it can be used anywhere a single Consul can
+var (
+	_ Store   = &Fanout{}
+	_ Drainer = &Fanout{}
+)
+
+// keep at most this many unkeyed operations, like those of events, queued per
+// target before refusing more. Keyed operations are never refused: there's at
+// most one queued per key, and refusing a sync would lose it until the next.
+const targetQueueSize = 1024
+
+// give up on an operation after this many failed attempts, so one that can't
+// succeed doesn't hold up everything queued behind it
+const targetMaxAttempts = 8
+
+var (
+	targetMinBackoff = 500 * time.Millisecond
+	targetMaxBackoff = 30 * time.Second
+)
+
+var (
+	ErrTargetClosed    = errors.New("target is shutting down")
+	ErrTargetQueueFull = errors.New("target queue is full")
+)
+
+// TargetError is an operation a target refused, or may not apply
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("target %s: %s", e.Target, e.Err)
+}
+
+type operation struct {
+	name string
+	// key identifies operations a later one makes obsolete, like syncs of the
+	// same thing. It's empty for operations that must all be applied.
+	key    string
+	apply  func(*Consul) error
+	queued time.Time
+}
+
+// TargetStatus is a snapshot of a Target's health and lag
+type TargetStatus struct {
+	Name        string    `json:"name"`
+	Healthy     bool      `json:"healthy"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	Lag         string    `json:"lag"`
+	Pending     int       `json:"pending"`
+	Dropped     int       `json:"dropped"`
+	// Failed counts operations given up on after failing too many times
+	Failed int `json:"failed"`
+}
+
+// Target is a single Consul datacenter receiving writes from a Fanout
+type Target struct {
+	Name   string
+	consul Consul
+	done   chan struct{}
+
+	lock        sync.Mutex
+	wake        *sync.Cond
+	ops         []operation
+	unkeyed     int
+	applying    bool
+	closed      bool
+	healthy     bool
+	lastError   error
+	lastSuccess time.Time
+	lag         time.Duration
+	dropped     int
+	abandoned   int
+}
+
+// NewTarget creates a Target writing to kv under the given prefix
+func NewTarget(name string, kv KVer, prefix string) *Target {
+	target := &Target{
+		Name:    name,
+		consul:  NewConsul(kv, prefix),
+		done:    make(chan struct{}),
+		healthy: true,
+	}
+	target.wake = sync.NewCond(&target.lock)
+	return target
+}
+
+// SetWriter sets the Writer the target applies sync writes with. It must be
+// called before the target is passed to NewFanout.
+func (t *Target) SetWriter(writer *Writer) {
+	t.consul.Writer = writer
+}
+
+// SetTombstoneRetention sets how long the target keeps tombstones of removed
+// tasks. It must be called before the target is passed to NewFanout.
+func (t *Target) SetTombstoneRetention(retention time.Duration) {
+	t.consul.TombstoneRetention = retention
+}
+
+// SetAppEncoding sets how the target serializes apps. It must be called
+// before the target is passed to NewFanout.
+func (t *Target) SetAppEncoding(encoding apps.Encoding) {
+	t.consul.AppEncoding = encoding
+}
+
+// SetAgents makes the target register services with agents. It must be
+// called before the target is passed to NewFanout.
+func (t *Target) SetAgents(agents *Agents) {
+	t.consul.Agents = agents
+}
+
+func (t *Target) logger() *log.Entry {
+	return log.WithField("target", t.Name)
+}
+
+// enqueue queues op, replacing a queued operation with the same key
+func (t *Target) enqueue(op operation) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		t.dropped++
+		t.logger().WithField("operation", op.name).Error("target is shutting down, dropping operation")
+		return ErrTargetClosed
+	}
+
+	if op.key != "" {
+		for i, queued := range t.ops {
+			if queued.key == op.key {
+				// the newer one goes last, so it's applied after anything
+				// queued in between
+				t.ops = append(t.ops[:i], t.ops[i+1:]...)
+				op.queued = queued.queued
+				break
+			}
+		}
+	}
+
+	if op.key == "" && t.unkeyed >= targetQueueSize {
+		t.dropped++
+		t.logger().WithField("operation", op.name).Error("queue full, dropping operation")
+		return ErrTargetQueueFull
+	}
+
+	if op.key == "" {
+		t.unkeyed++
+	}
+	t.ops = append(t.ops, op)
+	t.wake.Signal()
+	return nil
+}
+
+// close stops the target from accepting operations; run returns once the
+// queue is empty
+func (t *Target) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	t.wake.Broadcast()
+}
+
+// next waits for the next operation to apply. It returns false once the
+// target is closed and there's nothing left to apply.
+func (t *Target) next() (operation, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(t.ops) == 0 && !t.closed {
+		t.wake.Wait()
+	}
+	if len(t.ops) == 0 {
+		return operation{}, false
+	}
+
+	op := t.ops[0]
+	t.ops = t.ops[1:]
+	if op.key == "" {
+		t.unkeyed--
+	}
+	t.applying = true
+	return op, true
+}
+
+// pending counts the operations not applied yet, including the one being
+// applied
+func (t *Target) pending() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.applying {
+		return len(t.ops) + 1
+	}
+	return len(t.ops)
+}
+
+// run applies queued operations in order, retrying each one with backoff
+// until it succeeds, it fails in a way retrying won't fix, or it has failed
+// targetMaxAttempts times.
+func (t *Target) run() {
+	defer close(t.done)
+
+	for {
+		op, ok := t.next()
+		if !ok {
+			return
+		}
+
+		backoff := targetMinBackoff
+		for attempt := 1; ; attempt++ {
+			err := op.apply(&t.consul)
+			if err == nil {
+				t.succeeded(op)
+				break
+			}
+
+			if attempt >= targetMaxAttempts || permanent(err) {
+				t.gaveUp(op, err)
+				break
+			}
+
+			t.failed(op, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > targetMaxBackoff {
+				backoff = targetMaxBackoff
+			}
+		}
+	}
+}
+
+// permanent tells whether err won't go away by retrying: a request Consul
+// turned down, like one without the right ACL token, or a bad agent address
+func permanent(err error) bool {
+	if errs, ok := err.(Errors); ok {
+		for _, err := range errs {
+			if !permanent(err) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+
+	return err == ErrBadAgentAddress ||
+		strings.HasPrefix(err.Error(), "Unexpected response code: 4")
+}
+
+func (t *Target) succeeded(op operation) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.applying = false
+	if !t.healthy {
+		t.logger().Info("target recovered")
+	}
+	t.healthy = true
+	t.lastError = nil
+	t.lastSuccess = time.Now()
+	t.lag = t.lastSuccess.Sub(op.queued)
+
+	t.logger().WithFields(log.Fields{
+		"operation": op.name,
+		"lag":       t.lag,
+	}).Debug("applied operation")
+}
+
+func (t *Target) failed(op operation, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.healthy = false
+	t.lastError = err
+
+	t.logger().WithFields(log.Fields{
+		"operation": op.name,
+		"queued":    op.queued,
+	}).WithError(err).Error("operation failed, retrying")
+}
+
+func (t *Target) gaveUp(op operation, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.applying = false
+	t.healthy = false
+	t.lastError = err
+	t.abandoned++
+
+	t.logger().WithFields(log.Fields{
+		"operation": op.name,
+		"queued":    op.queued,
+	}).WithError(err).Error("operation failed, giving up")
+}
+
+// Status returns a snapshot of the target's health and lag
+func (t *Target) Status() TargetStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	status := TargetStatus{
+		Name:        t.Name,
+		Healthy:     t.healthy,
+		LastSuccess: t.lastSuccess,
+		Lag:         t.lag.String(),
+		Pending:     len(t.ops),
+		Dropped:     t.dropped,
+		Failed:      t.abandoned,
+	}
+	if t.lastError != nil {
+		status.LastError = t.lastError.Error()
+	}
+
+	return status
+}
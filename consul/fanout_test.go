@@ -0,0 +1,208 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenKVer fails every write, like a Consul datacenter that is down
+type brokenKVer struct {
+	mocks.KVer
+}
+
+func (kv brokenKVer) Put(*api.KVPair) (*api.WriteMeta, error) {
+	return nil, errors.New("datacenter unavailable")
+}
+
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFanoutUpdateApp(t *testing.T) {
+	t.Parallel()
+
+	dc1 := mocks.NewKVer()
+	dc2 := mocks.NewKVer()
+	fanout := NewFanout(
+		NewTarget("dc1", dc1, appPrefix),
+		NewTarget("dc2", dc2, appPrefix),
+	)
+
+	err := fanout.UpdateApp(testApp)
+	assert.Nil(t, err)
+
+	for _, kv := range []mocks.KVer{dc1, dc2} {
+		kv := kv
+		assert.True(t, waitFor(func() bool {
+			pair, _, _ := kv.Get("marathon/testApp")
+			return pair != nil
+		}))
+	}
+}
+
+func TestFanoutIndependentTargets(t *testing.T) {
+	t.Parallel()
+
+	healthy := mocks.NewKVer()
+	broken := brokenKVer{mocks.NewKVer()}
+	fanout := NewFanout(
+		NewTarget("healthy", healthy, appPrefix),
+		NewTarget("broken", broken, appPrefix),
+	)
+
+	err := fanout.UpdateTask(testTask)
+	assert.Nil(t, err)
+
+	// the healthy target gets the write even though the broken one is stuck
+	assert.True(t, waitFor(func() bool {
+		pair, _, _ := healthy.Get("marathon/testApp/tasks/testTask")
+		return pair != nil
+	}))
+
+	assert.True(t, waitFor(func() bool {
+		return !fanout.Targets[1].Status().Healthy
+	}))
+
+	statuses := fanout.Status().([]TargetStatus)
+	assert.True(t, statuses[0].Healthy)
+	assert.False(t, statuses[1].Healthy)
+	assert.Equal(t, "datacenter unavailable", statuses[1].LastError)
+}
+
+func TestFanoutDrain(t *testing.T) {
+	t.Parallel()
+
+	healthy := mocks.NewKVer()
+	fanout := NewFanout(NewTarget("healthy", healthy, appPrefix))
+	fanout.UpdateApp(testApp)
+
+	err := fanout.Drain(context.Background())
+	assert.Nil(t, err)
+
+	pair, _, _ := healthy.Get("marathon/testApp")
+	assert.NotNil(t, pair)
+
+	// writes after draining are refused instead of panicking
+	err = fanout.UpdateTask(testTask)
+	assert.Equal(t, Errors{&TargetError{"healthy", ErrTargetClosed}}, err)
+}
+
+func TestFanoutDrainDeadline(t *testing.T) {
+	t.Parallel()
+
+	broken := brokenKVer{mocks.NewKVer()}
+	fanout := NewFanout(NewTarget("broken", broken, appPrefix))
+	fanout.UpdateApp(testApp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := fanout.Drain(ctx)
+	assert.NotNil(t, err)
+}
+
+// forbiddenKVer turns down every write, like Consul without the right token
+type forbiddenKVer struct {
+	mocks.KVer
+}
+
+func (kv forbiddenKVer) Put(*api.KVPair) (*api.WriteMeta, error) {
+	return nil, errors.New("Unexpected response code: 403 (ACL not found)")
+}
+
+func TestFanoutGivesUpOnPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	forbidden := forbiddenKVer{mocks.NewKVer()}
+	target := NewTarget("forbidden", forbidden, appPrefix)
+	fanout := NewFanout(target)
+
+	ran := make(chan struct{})
+	fanout.UpdateApp(testApp)
+	fanout.enqueue("next", "", func(*Consul) error {
+		close(ran)
+		return nil
+	})
+
+	// what's behind the failed write isn't stuck
+	select {
+	case <-ran:
+	case <-time.After(2 * time.Second):
+		t.Fatal("operation queued behind a failed one never ran")
+	}
+	assert.True(t, waitFor(func() bool { return target.Status().Healthy }))
+	assert.Equal(t, 1, target.Status().Failed)
+}
+
+func TestFanoutQueuesPastFailingTargets(t *testing.T) {
+	t.Parallel()
+
+	broken := brokenKVer{mocks.NewKVer()}
+	fanout := NewFanout(NewTarget("broken", broken, appPrefix))
+
+	fanout.UpdateApp(testApp)
+	assert.True(t, waitFor(func() bool {
+		return !fanout.Targets[0].Status().Healthy
+	}))
+
+	// test! an earlier failure doesn't fail what's queued after it...
+	assert.Nil(t, fanout.UpdateTask(testTask))
+
+	// ...it's reported on /status instead
+	assert.Equal(t, "datacenter unavailable", fanout.Targets[0].Status().LastError)
+}
+
+func TestTargetReplacesQueuedSyncs(t *testing.T) {
+	t.Parallel()
+
+	// not running, so everything stays queued
+	target := NewTarget("dc1", mocks.NewKVer(), appPrefix)
+	noop := func(*Consul) error { return nil }
+
+	assert.Nil(t, target.enqueue(operation{name: "sync apps", key: "sync apps", apply: noop}))
+	assert.Nil(t, target.enqueue(operation{name: "update task", apply: noop}))
+	assert.Nil(t, target.enqueue(operation{name: "sync apps", key: "sync apps", apply: noop}))
+	assert.Equal(t, 2, target.pending())
+	assert.Equal(t, "update task", target.ops[0].name)
+
+	for target.unkeyed < targetQueueSize {
+		target.enqueue(operation{name: "update task", apply: noop})
+	}
+	assert.Equal(t, ErrTargetQueueFull, target.enqueue(operation{name: "update task", apply: noop}))
+
+	// a full queue still takes a newer sync in place of the queued one
+	assert.Nil(t, target.enqueue(operation{name: "sync apps", key: "sync apps", apply: noop}))
+	assert.Equal(t, 1, target.Status().Dropped)
+}
+
+func TestFanoutSyncsManyApps(t *testing.T) {
+	t.Parallel()
+
+	// not running, like a target busy with something else
+	target := NewTarget("dc1", mocks.NewKVer(), appPrefix)
+	fanout := &Fanout{[]*Target{target}}
+
+	// test!
+	apps := targetQueueSize + 100
+	for i := 0; i < apps; i++ {
+		appId := fmt.Sprintf("/app-%d", i)
+		assert.Nil(t, fanout.SyncTasks(appId, nil))
+		assert.Nil(t, fanout.SyncAppVersions(appId, nil))
+	}
+	assert.Equal(t, 2*apps, target.pending())
+	assert.Equal(t, 0, target.Status().Dropped)
+}
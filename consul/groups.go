@@ -0,0 +1,17 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/hashicorp/consul/api"
+)
+
+// SyncGroups takes a *complete* list of groups from Marathon and makes the
+// groups subtree match it, pruning groups that no longer exist.
+func (consul *Consul) SyncGroups(groupList []*groups.Group) error {
+	locals := make([]*api.KVPair, len(groupList))
+	for i, group := range groupList {
+		locals[i] = group.KV()
+	}
+
+	return consul.syncSubtree(groups.KeyPrefix, locals)
+}
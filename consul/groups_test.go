@@ -0,0 +1,32 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncGroups(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	deleteMe := &api.KVPair{Key: "marathon/_groups/deleteMe", Value: []byte("group")}
+	kv.Put(deleteMe)
+
+	// test!
+	consul := NewConsul(kv, appPrefix)
+	err := consul.SyncGroups([]*groups.Group{{ID: "/"}, {ID: "/product"}})
+	assert.Nil(t, err)
+
+	for _, key := range []string{"marathon/_groups/_root", "marathon/_groups/product"} {
+		result, _, err := kv.Get(key)
+		assert.Nil(t, err)
+		assert.NotNil(t, result, key)
+	}
+
+	result, _, err := kv.Get(deleteMe.Key)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
@@ -1,9 +1,46 @@
 package consul
 
 import (
+	"context"
+	"time"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/CiscoCloud/marathon-consul/tasks"
 	"github.com/hashicorp/consul/api"
 )
 
+// Store is implemented by anything that can hold Marathon state: a single
+// Consul datacenter (Consul) or several of them at once (Fanout).
+type Store interface {
+	SyncApps([]*apps.App) error
+	UpdateApp(*apps.App) error
+	DeleteApp(*apps.App) error
+	SyncAppVersions(string, []*apps.App) error
+	TrimAppVersions(string, int) error
+	SyncTasks(string, []*tasks.Task) error
+	UpdateTask(*tasks.Task) error
+	DeleteTask(*tasks.Task) error
+	ExpireTasks(time.Time) error
+	ExpireTombstones(time.Time) error
+	SyncPods([]*pods.Pod) error
+	UpdatePod(*pods.Pod) error
+	DeletePod(*pods.Pod) error
+	SyncPodInstances(string, []*pods.Instance) error
+	SyncDeployments([]*deployments.Deployment) error
+	UpdateDeployment(*deployments.Deployment) error
+	DeleteDeployment(*deployments.Deployment) error
+	SyncGroups([]*groups.Group) error
+}
+
+// Drainer is implemented by Stores that apply writes in the background and
+// need to finish them before shutting down
+type Drainer interface {
+	Drain(context.Context) error
+}
+
 type Getter interface {
 	Get(string) (*api.KVPair, *api.QueryMeta, error)
 }
@@ -0,0 +1,71 @@
+package consul
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/hashicorp/consul/api"
+)
+
+// SyncPods takes a *complete* list of pods from Marathon and compares them
+// against the pods in Consul. It performs any necessary updates, then deletes
+// any pods (and their instances) that are present in Consul but not the given
+// list.
+func (consul *Consul) SyncPods(podList []*pods.Pod) error {
+	remoteKeys, _, err := consul.kv.List(WithPrefix(consul.AppsPrefix, pods.KeyPrefix+"/"))
+	if err != nil {
+		return err
+	}
+	remotePairs := MapKVPairs(remoteKeys)
+
+	localPairs := make(map[string]*api.KVPair, len(podList))
+	writes := []func() error{}
+	for _, pod := range podList {
+		local := pod.KV()
+		local.Key = WithPrefix(consul.AppsPrefix, local.Key)
+		localPairs[local.Key] = local
+
+		remote, exists := remotePairs[local.Key]
+		if !exists || !bytes.Equal(local.Value, remote.Value) {
+			writes = append(writes, consul.put(local))
+		}
+	}
+
+	// remove any outdated pods, leaving instances to deleteTree
+	for _, remote := range remotePairs {
+		if strings.Contains(remote.Key, "/instances/") {
+			continue
+		}
+
+		if _, exists := localPairs[remote.Key]; !exists {
+			writes = append(writes, consul.deleteTree(remote.Key))
+		}
+	}
+
+	return consul.Writer.Apply(writes)
+}
+
+// UpdatePod takes a Pod and updates it in Consul
+func (consul *Consul) UpdatePod(pod *pods.Pod) error {
+	return consul.putIfChanged(pod.KV())
+}
+
+// DeletePod takes a Pod and deletes it and its instances from Consul
+func (consul *Consul) DeletePod(pod *pods.Pod) error {
+	return consul.deleteTree(WithPrefix(consul.AppsPrefix, pod.Key()))()
+}
+
+// SyncPodInstances takes a *complete* list of instances of a pod and compares
+// them against the instances in Consul. It performs any necessary updates,
+// then deletes any instances that are present in Consul but not the list.
+func (consul *Consul) SyncPodInstances(podId string, instances []*pods.Instance) error {
+	pod := &pods.Pod{ID: podId}
+
+	locals := make([]*api.KVPair, len(instances))
+	for i, instance := range instances {
+		locals[i] = instance.KV()
+	}
+
+	return consul.syncSubtree(pod.InstancesKey(), locals)
+}
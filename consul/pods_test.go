@@ -0,0 +1,108 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var (
+	testPod      = &pods.Pod{ID: "/testPod"}
+	testInstance = &pods.Instance{ID: "testPod.instance-1", PodID: "/testPod"}
+)
+
+func TestSyncPods(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+
+	deleteMe := &api.KVPair{Key: "marathon/_pods/deleteMe", Value: []byte("pod")}
+	deleteMeInstance := &api.KVPair{Key: "marathon/_pods/deleteMe/instances/test", Value: []byte("instance")}
+	kv.Put(deleteMe)
+	kv.Put(deleteMeInstance)
+
+	// test!
+	consul := NewConsul(kv, appPrefix)
+	err := consul.SyncPods([]*pods.Pod{testPod})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/_pods/testPod")
+	assert.Nil(t, err)
+	assert.Equal(t, testPod.KV().Value, result.Value)
+
+	for _, deleted := range []string{deleteMe.Key, deleteMeInstance.Key} {
+		result, _, err := kv.Get(deleted)
+		assert.Nil(t, err)
+		assert.Nil(t, result)
+	}
+}
+
+func TestSyncAppsKeepsPods(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	assert.Nil(t, consul.UpdatePod(testPod))
+	assert.Nil(t, consul.SyncPodInstances(testPod.ID, []*pods.Instance{testInstance}))
+
+	// test!
+	err := consul.SyncApps([]*apps.App{testApp})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/_pods/testPod")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+
+	result, _, err = kv.Get("marathon/_pods/testPod/instances/testPod.instance-1")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+}
+
+func TestSyncPodInstances(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+
+	deleteMe := &api.KVPair{Key: "marathon/_pods/testPod/instances/deleteMe", Value: []byte("instance")}
+	other := &api.KVPair{Key: "marathon/_pods/testPodToo/instances/other", Value: []byte("instance")}
+	kv.Put(deleteMe)
+	kv.Put(other)
+
+	// test!
+	consul := NewConsul(kv, appPrefix)
+	err := consul.SyncPodInstances(testPod.ID, []*pods.Instance{testInstance})
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("marathon/_pods/testPod/instances/testPod.instance-1")
+	assert.Nil(t, err)
+	assert.Equal(t, testInstance.KV().Value, result.Value)
+
+	result, _, err = kv.Get(deleteMe.Key)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	// instances of a pod whose name merely starts the same are left alone
+	result, _, err = kv.Get(other.Key)
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+}
+
+func TestDeletePod(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	consul := NewConsul(kv, appPrefix)
+	assert.Nil(t, consul.UpdatePod(testPod))
+	assert.Nil(t, consul.SyncPodInstances(testPod.ID, []*pods.Instance{testInstance}))
+
+	// test!
+	err := consul.DeletePod(testPod)
+	assert.Nil(t, err)
+
+	remaining, _, err := kv.List("marathon/_pods")
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 0)
+}
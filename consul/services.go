@@ -0,0 +1,316 @@
+package consul
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	"github.com/CiscoCloud/marathon-consul/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// ServiceIDPrefix starts the ID of every service registered for a task, so
+// services registered by anything else are left alone
+const ServiceIDPrefix = "marathon:"
+
+// metadata tying a registration back to its app and task
+const (
+	MetaApp  = "marathon-app"
+	MetaTask = "marathon-task"
+)
+
+// Agent registers services with a Consul agent. *api.Agent is one.
+type Agent interface {
+	Services() (map[string]*api.AgentService, error)
+	ServiceRegister(*api.AgentServiceRegistration) error
+	ServiceDeregister(string) error
+}
+
+// NewAgent connects to the Consul agent in config
+func NewAgent(config *api.Config) (Agent, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.Agent(), nil
+}
+
+// Registrations returns a service registration per registered port of task,
+// as service describes them. Tasks that aren't serving aren't registered.
+func Registrations(service apps.Service, task *tasks.Task) []*api.AgentServiceRegistration {
+	if !service.Register || !task.Serving() {
+		return nil
+	}
+
+	registrations := []*api.AgentServiceRegistration{}
+	for _, port := range service.Ports {
+		address, number, ok := taskAddress(service, port, task)
+		if !ok {
+			continue
+		}
+
+		registration := &api.AgentServiceRegistration{
+			ID:      ServiceIDPrefix + task.ID,
+			Name:    service.Name,
+			Tags:    append([]string{}, service.Tags...),
+			Port:    number,
+			Address: address,
+			Meta:    map[string]string{MetaApp: task.AppID, MetaTask: task.ID},
+		}
+		for key, value := range service.Meta {
+			registration.Meta[key] = value
+		}
+		if port.Name != "" {
+			registration.ID += ":" + port.Name
+			registration.Name += "-" + port.Name
+			registration.Tags = append(registration.Tags, port.Name)
+		}
+		if service.Connect {
+			registration.Connect = sidecar(service.Upstreams)
+		}
+		registrations = append(registrations, registration)
+	}
+
+	return registrations
+}
+
+// taskAddress tells where task serves port: on its own IP address with
+// IP-per-task or on a USER network, on its host otherwise. Ports the task
+// wasn't given aren't served anywhere.
+func taskAddress(service apps.Service, port apps.ServicePort, task *tasks.Task) (string, int, bool) {
+	served := apps.TaskPort{HostIndex: port.Index}
+	if port.Index < len(service.TaskPorts) {
+		served = service.TaskPorts[port.Index]
+	}
+
+	if served.ContainerPort != 0 && len(task.IPAddresses) > 0 {
+		return task.IPAddresses[0].IPAddress, served.ContainerPort, true
+	}
+	if served.HostIndex >= 0 && served.HostIndex < len(task.Ports) {
+		return task.Host, task.Ports[served.HostIndex], true
+	}
+	return "", 0, false
+}
+
+// sidecar asks the agent to register a Connect sidecar proxy for upstreams.
+// The agent picks its port and names it <service>-sidecar-proxy. Agents older
+// than Consul 1.3 don't know about sidecar services.
+func sidecar(upstreams []apps.Upstream) *api.AgentServiceConnect {
+	proxy := &api.AgentServiceConnectProxyConfig{}
+	for _, upstream := range upstreams {
+		proxy.Upstreams = append(proxy.Upstreams, api.Upstream{
+			DestinationName: upstream.Service,
+			LocalBindPort:   upstream.LocalPort,
+		})
+	}
+
+	return &api.AgentServiceConnect{
+		SidecarService: &api.AgentServiceRegistration{Proxy: proxy},
+	}
+}
+
+// appService reads how the stored app with appId is exposed as services. If
+// there's no such app, it isn't.
+func (consul *Consul) appService(appId string) (apps.Service, error) {
+	remote, _, err := consul.kv.Get(WithPrefix(consul.AppsPrefix, utils.CleanID(appId)))
+	if err != nil || remote == nil {
+		return apps.Service{}, err
+	}
+
+	app := &apps.App{}
+	err = json.Unmarshal(remote.Value, app)
+	if err != nil {
+		return apps.Service{}, err
+	}
+
+	service, _ := app.Service()
+	return service, nil
+}
+
+// syncServices makes the services registered for the tasks that owned selects
+// exactly locals, by the host of their task: it registers new and changed
+// services, then deregisters any that are registered but not in locals. It
+// looks at the agents of locals and of hosts (where those tasks ran before),
+// and with sweep at every agent used so far, so services don't linger on agents their tasks left. Only failures
+// to register locals are returned: agents that are merely cleaned up may be
+// gone with their host, so their failures are logged. Without Agents, it does
+// nothing.
+func (consul *Consul) syncServices(sweep bool, hosts []string, owned func(*api.AgentService) bool, locals map[string][]*api.AgentServiceRegistration) error {
+	if consul.Agents == nil {
+		return nil
+	}
+
+	byAddress := map[string][]*api.AgentServiceRegistration{}
+	if sweep {
+		for _, address := range consul.Agents.Known() {
+			byAddress[address] = nil
+		}
+	}
+	for _, host := range hosts {
+		address, err := consul.Agents.Address(host)
+		if err != nil {
+			return err
+		}
+		byAddress[address] = nil
+	}
+	for host, registrations := range locals {
+		address, err := consul.Agents.Address(host)
+		if err != nil {
+			return err
+		}
+		byAddress[address] = append(byAddress[address], registrations...)
+	}
+
+	addresses := make([]string, 0, len(byAddress))
+	for address := range byAddress {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	// one agent being down doesn't keep the others from being synced
+	errs := Errors{}
+	for _, address := range addresses {
+		agent, err := consul.Agents.Agent(address)
+		var remotes map[string]*api.AgentService
+		if err == nil {
+			remotes, err = agent.Services()
+			consul.Agents.reached(address, err)
+		}
+		if err == nil {
+			err = consul.syncAgent(agent, remotes, owned, byAddress[address])
+		}
+
+		switch {
+		case err == nil:
+		case len(byAddress[address]) > 0:
+			errs = append(errs, err)
+		default:
+			log.WithError(err).WithField("agent", address).Warn("couldn't clean up services")
+		}
+	}
+	return errs.err()
+}
+
+// syncAgent is syncServices for a single agent, given the services registered
+// with it
+func (consul *Consul) syncAgent(agent Agent, remotes map[string]*api.AgentService, owned func(*api.AgentService) bool, locals []*api.AgentServiceRegistration) error {
+	localIDs := make(map[string]bool, len(locals))
+	writes := []func() error{}
+	for _, local := range locals {
+		localIDs[local.ID] = true
+
+		remote, exists := remotes[local.ID]
+		if !exists || !sameService(remote, local) || !sameSidecar(remotes[sidecarID(local.ID)], local) {
+			writes = append(writes, register(agent, local))
+		}
+
+		// a sidecar that's no longer wanted doesn't go away by itself
+		if _, exists := remotes[sidecarID(local.ID)]; exists && local.Connect == nil {
+			writes = append(writes, deregister(agent, sidecarID(local.ID)))
+		}
+	}
+
+	for id, remote := range remotes {
+		// sidecars are deregistered with their service
+		if remote.Kind == api.ServiceKindConnectProxy {
+			continue
+		}
+
+		if strings.HasPrefix(id, ServiceIDPrefix) && owned(remote) && !localIDs[id] {
+			writes = append(writes, deregister(agent, id))
+		}
+	}
+
+	return consul.Writer.Apply(writes)
+}
+
+// taskHosts lists the hosts of the stored tasks among pairs
+func taskHosts(pairs api.KVPairs) []string {
+	hosts := []string{}
+	for _, pair := range pairs {
+		if !strings.Contains(pair.Key, "/tasks/") {
+			continue
+		}
+
+		task, err := tasks.ParseTask(pair.Value)
+		if err == nil && task.Host != "" {
+			hosts = append(hosts, task.Host)
+		}
+	}
+	return hosts
+}
+
+// ofApps selects the services registered for the tasks of apps
+func ofApps(appIds ...string) func(*api.AgentService) bool {
+	return func(remote *api.AgentService) bool {
+		for _, appId := range appIds {
+			if remote.Meta[MetaApp] == appId {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ofTask selects the services registered for a task
+func ofTask(taskId string) func(*api.AgentService) bool {
+	return func(remote *api.AgentService) bool {
+		return remote.Meta[MetaTask] == taskId
+	}
+}
+
+// register returns a write registering a service with agent, for a Writer
+func register(agent Agent, registration *api.AgentServiceRegistration) func() error {
+	return func() error {
+		return agent.ServiceRegister(registration)
+	}
+}
+
+// deregister returns a write deregistering a service from agent, for a Writer
+func deregister(agent Agent, id string) func() error {
+	return func() error {
+		return agent.ServiceDeregister(id)
+	}
+}
+
+func sameService(remote *api.AgentService, local *api.AgentServiceRegistration) bool {
+	return remote.Service == local.Name &&
+		remote.Port == local.Port &&
+		remote.Address == local.Address &&
+		len(remote.Tags) == len(local.Tags) &&
+		(len(local.Tags) == 0 || reflect.DeepEqual(remote.Tags, local.Tags)) &&
+		reflect.DeepEqual(remote.Meta, local.Meta)
+}
+
+// sidecarID is the ID the agent gives the sidecar proxy of a service
+func sidecarID(id string) string {
+	return id + "-sidecar-proxy"
+}
+
+// sameSidecar tells whether remote, the registered sidecar of local if any,
+// proxies what local asks for
+func sameSidecar(remote *api.AgentService, local *api.AgentServiceRegistration) bool {
+	if local.Connect == nil || remote == nil {
+		return local.Connect == nil
+	}
+
+	// the agent fills in defaults for whatever else upstreams have, so only
+	// what we set is compared, in any order
+	wanted := map[apps.Upstream]bool{}
+	for _, upstream := range local.Connect.SidecarService.Proxy.Upstreams {
+		wanted[apps.Upstream{Service: upstream.DestinationName, LocalPort: upstream.LocalBindPort}] = true
+	}
+	if remote.Proxy == nil || len(remote.Proxy.Upstreams) != len(wanted) {
+		return false
+	}
+	for _, upstream := range remote.Proxy.Upstreams {
+		if !wanted[apps.Upstream{Service: upstream.DestinationName, LocalPort: upstream.LocalBindPort}] {
+			return false
+		}
+	}
+	return true
+}
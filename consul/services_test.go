@@ -0,0 +1,308 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+var portedApp = &apps.App{
+	ID:     "/web",
+	Labels: map[string]string{"consul.service.tags": "v1"},
+	PortDefinitions: []apps.PortDefinition{
+		{Port: 10000, Name: "http"},
+		{Port: 10001, Name: "metrics"},
+	},
+}
+
+func portedTask(id string) *tasks.Task {
+	return &tasks.Task{ID: id, AppID: "/web", Host: "agent-1", Ports: []int{31000, 31001}}
+}
+
+func TestRegistrations(t *testing.T) {
+	t.Parallel()
+
+	service, _ := portedApp.Service()
+	registrations := Registrations(service, portedTask("web.1"))
+	assert.Equal(t, []*api.AgentServiceRegistration{
+		{
+			ID:      "marathon:web.1:http",
+			Name:    "web-http",
+			Tags:    []string{"v1", "http"},
+			Port:    31000,
+			Address: "agent-1",
+			Meta:    map[string]string{MetaApp: "/web", MetaTask: "web.1"},
+		},
+		{
+			ID:      "marathon:web.1:metrics",
+			Name:    "web-metrics",
+			Tags:    []string{"v1", "metrics"},
+			Port:    31001,
+			Address: "agent-1",
+			Meta:    map[string]string{MetaApp: "/web", MetaTask: "web.1"},
+		},
+	}, registrations)
+
+	// tasks on their way out aren't registered
+	marked := portedTask("web.1")
+	marked.TaskStatus = tasks.Unreachable
+	assert.Len(t, Registrations(service, marked), 0)
+}
+
+func TestSyncTasksRegisters(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	agent := mocks.NewAgent()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = CentralAgent(agent)
+
+	// something else's service is none of our business
+	agent.ServiceRegister(&api.AgentServiceRegistration{ID: "redis", Name: "redis"})
+
+	// test!
+	assert.Nil(t, consul.SyncApps([]*apps.App{portedApp}))
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{portedTask("web.1"), portedTask("web.2")}))
+
+	services, _ := agent.Services()
+	assert.Len(t, services, 5)
+	assert.Equal(t, "web-metrics", services["marathon:web.2:metrics"].Service)
+
+	// tasks that went away are deregistered
+	assert.Nil(t, consul.SyncTasks(portedApp.ID, []*tasks.Task{portedTask("web.2")}))
+	services, _ = agent.Services()
+	assert.Len(t, services, 3)
+	assert.Nil(t, services["marathon:web.1:http"])
+
+	// and so are tasks that stop serving
+	unreachable := portedTask("web.2")
+	unreachable.TaskStatus = tasks.Unreachable
+	unreachable.Mark(time.Now())
+	assert.Nil(t, consul.UpdateTask(unreachable))
+	services, _ = agent.Services()
+	assert.Len(t, services, 1)
+
+	// and apps that went away
+	assert.Nil(t, consul.UpdateTask(portedTask("web.2")))
+	services, _ = agent.Services()
+	assert.Len(t, services, 3)
+
+	assert.Nil(t, consul.SyncApps([]*apps.App{}))
+	services, _ = agent.Services()
+	assert.Len(t, services, 1)
+	assert.NotNil(t, services["redis"])
+}
+
+func TestDeleteTaskDeregisters(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	agent := mocks.NewAgent()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = CentralAgent(agent)
+
+	assert.Nil(t, consul.UpdateApp(portedApp))
+	assert.Nil(t, consul.UpdateTask(portedTask("web.1")))
+	services, _ := agent.Services()
+	assert.Len(t, services, 2)
+
+	// test!
+	assert.Nil(t, consul.DeleteTask(portedTask("web.1")))
+	services, _ = agent.Services()
+	assert.Len(t, services, 0)
+}
+
+func TestSyncTasksConnect(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	agent := mocks.NewAgent()
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = CentralAgent(agent)
+
+	app := &apps.App{
+		ID:     "/web",
+		Ports:  []int{10000},
+		Labels: map[string]string{"consul.connect": "true", "consul.connect.upstreams": "db:5432"},
+	}
+	task := &tasks.Task{ID: "web.1", AppID: "/web", Host: "agent-1", Ports: []int{31000}}
+
+	// test!
+	assert.Nil(t, consul.UpdateApp(app))
+	assert.Nil(t, consul.SyncTasks(app.ID, []*tasks.Task{task}))
+	services, _ := agent.Services()
+	assert.Len(t, services, 2)
+	sidecar := services["marathon:web.1-sidecar-proxy"]
+	assert.Equal(t, api.ServiceKindConnectProxy, sidecar.Kind)
+	assert.Equal(t, []api.Upstream{{DestinationName: "db", LocalBindPort: 5432}}, sidecar.Proxy.Upstreams)
+
+	// changed upstreams are registered again
+	app.Labels["consul.connect.upstreams"] = "db:5433"
+	assert.Nil(t, consul.UpdateApp(app))
+	assert.Nil(t, consul.SyncTasks(app.ID, []*tasks.Task{task}))
+	services, _ = agent.Services()
+	assert.Equal(t, 5433, services["marathon:web.1-sidecar-proxy"].Proxy.Upstreams[0].LocalBindPort)
+
+	// the sidecar goes when it's no longer wanted
+	delete(app.Labels, "consul.connect")
+	assert.Nil(t, consul.UpdateApp(app))
+	assert.Nil(t, consul.SyncTasks(app.ID, []*tasks.Task{task}))
+	services, _ = agent.Services()
+	assert.Len(t, services, 1)
+	assert.NotNil(t, services["marathon:web.1"])
+}
+
+// agentServices is what a Consul 1.3 agent's /v1/agent/services says about a
+// task registered with a sidecar, defaults and all
+const agentServices = `{
+    "marathon:web.1": {
+        "Kind": "",
+        "ID": "marathon:web.1",
+        "Service": "web",
+        "Tags": [],
+        "Meta": {"marathon-app": "/web", "marathon-task": "web.1"},
+        "Port": 31000,
+        "Address": "agent-1",
+        "Weights": {"Passing": 1, "Warning": 1},
+        "EnableTagOverride": false,
+        "ContentHash": "c25ac1d8b1b7ea2b",
+        "Connect": {}
+    },
+    "marathon:web.1-sidecar-proxy": {
+        "Kind": "connect-proxy",
+        "ID": "marathon:web.1-sidecar-proxy",
+        "Service": "web-sidecar-proxy",
+        "Tags": [],
+        "Meta": {"marathon-app": "/web", "marathon-task": "web.1"},
+        "Port": 21000,
+        "Address": "agent-1",
+        "Weights": {"Passing": 1, "Warning": 1},
+        "EnableTagOverride": false,
+        "ContentHash": "4a6e0a2e8e3b9c2f",
+        "Proxy": {
+            "DestinationServiceName": "web",
+            "DestinationServiceID": "marathon:web.1",
+            "LocalServiceAddress": "127.0.0.1",
+            "LocalServicePort": 31000,
+            "Config": {},
+            "Upstreams": [
+                {"DestinationType": "service", "DestinationName": "cache", "LocalBindPort": 6379},
+                {"DestinationType": "service", "DestinationName": "db", "LocalBindPort": 5432}
+            ]
+        }
+    }
+}`
+
+// recordedAgent answers with agentServices, and counts registrations
+type recordedAgent struct {
+	writes *int
+}
+
+func (a recordedAgent) Services() (map[string]*api.AgentService, error) {
+	services := map[string]*api.AgentService{}
+	err := json.Unmarshal([]byte(agentServices), &services)
+	return services, err
+}
+
+func (a recordedAgent) ServiceRegister(*api.AgentServiceRegistration) error {
+	*a.writes++
+	return nil
+}
+
+func (a recordedAgent) ServiceDeregister(string) error {
+	*a.writes++
+	return nil
+}
+
+func TestSyncTasksConnectUnchanged(t *testing.T) {
+	t.Parallel()
+
+	kv := mocks.NewKVer()
+	writes := 0
+	consul := NewConsul(kv, appPrefix)
+	consul.Agents = CentralAgent(recordedAgent{&writes})
+
+	app := &apps.App{
+		ID:     "/web",
+		Ports:  []int{10000},
+		Labels: map[string]string{"consul.connect": "true", "consul.connect.upstreams": "db:5432,cache:6379"},
+	}
+	task := &tasks.Task{ID: "web.1", AppID: "/web", Host: "agent-1", Ports: []int{31000}}
+
+	// test!
+	assert.Nil(t, consul.UpdateApp(app))
+	assert.Nil(t, consul.SyncTasks(app.ID, []*tasks.Task{task}))
+	assert.Equal(t, 0, writes)
+}
+
+func TestRegistrationsIPPerTask(t *testing.T) {
+	t.Parallel()
+
+	app := &apps.App{
+		ID: "/web",
+		IPAddress: &apps.IPAddress{Discovery: &apps.Discovery{Ports: []apps.DiscoveryPort{
+			{Number: 8080, Name: "http", Protocol: "tcp"},
+		}}},
+	}
+	task := &tasks.Task{
+		ID: "web.1", AppID: "/web", Host: "agent-1",
+		IPAddresses: []tasks.IPAddress{{IPAddress: "9.0.0.12", Protocol: "IPv4"}},
+	}
+
+	service, _ := app.Service()
+	registrations := Registrations(service, task)
+	assert.Len(t, registrations, 1)
+	assert.Equal(t, "9.0.0.12", registrations[0].Address)
+	assert.Equal(t, 8080, registrations[0].Port)
+}
+
+func TestRegistrationsNetworks(t *testing.T) {
+	t.Parallel()
+
+	// admin has no host port on the USER network, so metrics gets the task's
+	// only one
+	mappings := []byte(`{"id": "/web", "container": {"docker": {"network": "USER", "portMappings": [
+		{"containerPort": 8080, "hostPort": 0, "name": "http"},
+		{"containerPort": 9000, "name": "admin"},
+		{"containerPort": 9100, "hostPort": 0, "name": "metrics"}
+	]}}}`)
+	app := &apps.App{}
+	assert.Nil(t, json.Unmarshal(mappings, app))
+	task := &tasks.Task{
+		ID: "web.1", AppID: "/web", Host: "agent-1", Ports: []int{31000, 31001},
+		IPAddresses: []tasks.IPAddress{{IPAddress: "9.0.0.12", Protocol: "IPv4"}},
+	}
+
+	service, _ := app.Service()
+	ports := map[string]string{}
+	for _, registration := range Registrations(service, task) {
+		ports[registration.Name] = fmt.Sprintf("%s:%d", registration.Address, registration.Port)
+	}
+	assert.Equal(t, map[string]string{
+		"web-admin":   "9.0.0.12:9000",
+		"web-http":    "9.0.0.12:8080",
+		"web-metrics": "9.0.0.12:9100",
+	}, ports)
+
+	// on a bridge, every mapping gets a host port, and that's where tasks
+	// are reached
+	app.Container.Docker.Network = apps.NetworkBridge
+	task.Ports = []int{31000, 31001, 31002}
+	service, _ = app.Service()
+	ports = map[string]string{}
+	for _, registration := range Registrations(service, task) {
+		ports[registration.Name] = fmt.Sprintf("%s:%d", registration.Address, registration.Port)
+	}
+	assert.Equal(t, map[string]string{
+		"web-admin":   "agent-1:31001",
+		"web-http":    "agent-1:31000",
+		"web-metrics": "agent-1:31002",
+	}, ports)
+}
@@ -22,6 +22,13 @@ func WithoutPrefix(prefix, key string) string {
 	return key
 }
 
+// isReserved tells whether key lives in a subtree that isn't an app, like
+// "_pods". Marathon IDs can't start with an underscore, so these can't
+// collide with apps.
+func isReserved(prefix, key string) bool {
+	return strings.HasPrefix(WithoutPrefix(prefix, key), "_")
+}
+
 func MapKVPairs(source api.KVPairs) map[string]*api.KVPair {
 	pairs := make(map[string]*api.KVPair, len(source))
 	for _, pair := range source {
@@ -30,10 +37,10 @@ func MapKVPairs(source api.KVPairs) map[string]*api.KVPair {
 	return pairs
 }
 
-func MapApps(source []*apps.App) map[string]*api.KVPair {
+func MapApps(source []*apps.App, encoding apps.Encoding) map[string]*api.KVPair {
 	pairs := make(map[string]*api.KVPair, len(source))
 	for _, app := range source {
-		pair := app.KV()
+		pair := app.EncodedKV(encoding)
 		pairs[pair.Key] = pair
 	}
 	return pairs
@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writer applies batches of KV writes on a bounded number of workers and,
+// optionally, at a limited rate. A nil Writer applies writes one at a time,
+// as fast as Consul takes them.
+type Writer struct {
+	concurrency int
+	interval    time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+// NewWriter creates a Writer running at most concurrency writes at once and
+// starting at most rate writes per second. A rate of 0 means no limit.
+func NewWriter(concurrency int, rate float64) *Writer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	writer := &Writer{concurrency: concurrency}
+	if rate > 0 {
+		writer.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return writer
+}
+
+// Apply runs every write, carrying on past failed ones, and returns the
+// errors of all that failed
+func (w *Writer) Apply(writes []func() error) error {
+	if w == nil {
+		errs := Errors{}
+		for _, write := range writes {
+			if err := write(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errs.err()
+	}
+
+	queue := make(chan func() error)
+	results := make(chan error, len(writes))
+
+	workers := w.concurrency
+	if workers > len(writes) {
+		workers = len(writes)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for write := range queue {
+				w.wait()
+				results <- write()
+			}
+		}()
+	}
+
+	for _, write := range writes {
+		queue <- write
+	}
+	close(queue)
+
+	errs := Errors{}
+	for range writes {
+		if err := <-results; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.err()
+}
+
+// wait blocks until the rate limit allows another write
+func (w *Writer) wait() {
+	if w.interval == 0 {
+		return
+	}
+
+	w.lock.Lock()
+	now := time.Now()
+	if w.next.Before(now) {
+		w.next = now
+	}
+	slot := w.next
+	w.next = w.next.Add(w.interval)
+	w.lock.Unlock()
+
+	time.Sleep(slot.Sub(now))
+}
+
+// Errors collects the errors of several writes
+type Errors []error
+
+func (errs Errors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d writes failed: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// err returns errs as an error, or nil if there are none
+func (errs Errors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
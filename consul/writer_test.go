@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterConcurrency(t *testing.T) {
+	t.Parallel()
+
+	lock := sync.Mutex{}
+	running, most := 0, 0
+	writes := make([]func() error, 20)
+	for i := range writes {
+		writes[i] = func() error {
+			lock.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			lock.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return nil
+		}
+	}
+
+	err := NewWriter(3, 0).Apply(writes)
+	assert.Nil(t, err)
+	assert.True(t, most <= 3, "ran %d writes at once", most)
+	assert.True(t, most > 1, "never ran writes concurrently")
+}
+
+func TestWriterRateLimit(t *testing.T) {
+	t.Parallel()
+
+	writes := make([]func() error, 5)
+	for i := range writes {
+		writes[i] = func() error { return nil }
+	}
+
+	start := time.Now()
+	err := NewWriter(5, 100).Apply(writes)
+	assert.Nil(t, err)
+	// the first write goes out right away, the other four wait 10ms each
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestWriterErrors(t *testing.T) {
+	t.Parallel()
+
+	applied := 0
+	lock := sync.Mutex{}
+	writes := []func() error{
+		func() error { return errors.New("first") },
+		func() error { lock.Lock(); applied++; lock.Unlock(); return nil },
+		func() error { return errors.New("second") },
+	}
+
+	for _, writer := range []*Writer{nil, NewWriter(2, 0)} {
+		applied = 0
+		err := writer.Apply(writes)
+		assert.NotNil(t, err)
+		assert.Len(t, err.(Errors), 2)
+		// failures don't stop the other writes
+		assert.Equal(t, 1, applied)
+	}
+
+	assert.Nil(t, NewWriter(2, 0).Apply(nil))
+}
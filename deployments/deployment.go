@@ -0,0 +1,66 @@
+package deployments
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/CiscoCloud/marathon-consul/utils"
+	"github.com/hashicorp/consul/api"
+)
+
+// KeyPrefix is the subtree deployments in progress live in
+const KeyPrefix = "_deployments"
+
+// deployment statuses
+const (
+	Running       = "running"
+	StepSucceeded = "step_succeeded"
+	StepFailed    = "step_failed"
+)
+
+type Action struct {
+	Action string `json:"action"`
+	App    string `json:"app,omitempty"`
+	Pod    string `json:"pod,omitempty"`
+}
+
+type Step struct {
+	Actions []Action `json:"actions"`
+}
+
+// Deployment is a deployment in progress, shaped like the entries of
+// /v2/deployments
+type Deployment struct {
+	ID             string   `json:"id"`
+	Version        string   `json:"version"`
+	AffectedApps   []string `json:"affectedApps"`
+	AffectedPods   []string `json:"affectedPods"`
+	Steps          []Step   `json:"steps"`
+	CurrentActions []Action `json:"currentActions"`
+	CurrentStep    int      `json:"currentStep"`
+	TotalSteps     int      `json:"totalSteps"`
+	Status         string   `json:"status"`
+}
+
+func (deployment *Deployment) KV() *api.KVPair {
+	serialized, _ := json.Marshal(deployment)
+
+	return &api.KVPair{
+		Key:   deployment.Key(),
+		Value: serialized,
+	}
+}
+
+func (deployment *Deployment) Key() string {
+	return fmt.Sprintf("%s/%s", KeyPrefix, utils.CleanID(deployment.ID))
+}
+
+// ParseDeployments parses /v2/deployments. Marathon only lists deployments
+// in progress, so they are all running.
+func ParseDeployments(jsonBlob []byte) ([]*Deployment, error) {
+	deployments := []*Deployment{}
+	err := json.Unmarshal(jsonBlob, &deployments)
+	for _, deployment := range deployments {
+		deployment.Status = Running
+	}
+	return deployments, err
+}
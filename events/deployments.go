@@ -0,0 +1,111 @@
+package events
+
+import (
+	"encoding/json"
+
+	"github.com/CiscoCloud/marathon-consul/deployments"
+)
+
+// DeploymentStep is a step of a deployment plan. Marathon before 0.9 sent a
+// single action per step, directly on the step.
+type DeploymentStep struct {
+	Actions []deployments.Action `json:"actions"`
+	Action  string               `json:"action"`
+	App     string               `json:"app"`
+}
+
+func (step DeploymentStep) actions() []deployments.Action {
+	if len(step.Actions) == 0 && step.Action != "" {
+		return []deployments.Action{{Action: step.Action, App: step.App}}
+	}
+	return step.Actions
+}
+
+// DeploymentEvent is any of deployment_info, deployment_success,
+// deployment_failed, deployment_step_success and deployment_step_failure
+type DeploymentEvent struct {
+	Type      string `json:"eventType"`
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Plan      struct {
+		ID      string           `json:"id"`
+		Version string           `json:"version"`
+		Steps   []DeploymentStep `json:"steps"`
+	} `json:"plan"`
+	CurrentStep DeploymentStep `json:"currentStep"`
+}
+
+func (event DeploymentEvent) GetType() string {
+	return event.Type
+}
+
+// Finished tells whether the deployment is over, successfully or not
+func (event DeploymentEvent) Finished() bool {
+	return event.Type == "deployment_success" || event.Type == "deployment_failed"
+}
+
+// Deployment describes the deployment as of this event
+func (event DeploymentEvent) Deployment() *deployments.Deployment {
+	deployment := &deployments.Deployment{
+		ID:             event.Plan.ID,
+		Version:        event.Plan.Version,
+		AffectedApps:   []string{},
+		AffectedPods:   []string{},
+		CurrentActions: event.CurrentStep.actions(),
+		TotalSteps:     len(event.Plan.Steps),
+		Status:         deployments.Running,
+	}
+	// deployment_success and deployment_failed may come without a plan
+	if deployment.ID == "" {
+		deployment.ID = event.ID
+	}
+
+	switch event.Type {
+	case "deployment_step_success":
+		deployment.Status = deployments.StepSucceeded
+	case "deployment_step_failure":
+		deployment.Status = deployments.StepFailed
+	}
+
+	seenApps := map[string]bool{}
+	seenPods := map[string]bool{}
+	for i, step := range event.Plan.Steps {
+		actions := step.actions()
+		deployment.Steps = append(deployment.Steps, deployments.Step{Actions: actions})
+		if deployment.CurrentStep == 0 && sameActions(actions, deployment.CurrentActions) {
+			deployment.CurrentStep = i + 1
+		}
+
+		for _, action := range actions {
+			if action.App != "" && !seenApps[action.App] {
+				seenApps[action.App] = true
+				deployment.AffectedApps = append(deployment.AffectedApps, action.App)
+			}
+			if action.Pod != "" && !seenPods[action.Pod] {
+				seenPods[action.Pod] = true
+				deployment.AffectedPods = append(deployment.AffectedPods, action.Pod)
+			}
+		}
+	}
+
+	return deployment
+}
+
+func sameActions(a, b []deployments.Action) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDeploymentEvent parses any deployment event
+func ParseDeploymentEvent(jsonBlob []byte) (DeploymentEvent, error) {
+	event := DeploymentEvent{}
+	err := json.Unmarshal(jsonBlob, &event)
+	return event, err
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentEventDeployment(t *testing.T) {
+	t.Parallel()
+
+	event, err := ParseDeploymentEvent([]byte(`{
+		"eventType": "deployment_step_success",
+		"timestamp": "2017-03-01T10:00:00.000Z",
+		"plan": {
+			"id": "867ed450-f6a8-4d33-9b0e-e11c5513990b",
+			"version": "2017-03-01T09:59:58.000Z",
+			"steps": [
+				{"actions": [{"action": "StartApplication", "app": "/product/db"}]},
+				{"actions": [{"action": "ScaleApplication", "app": "/product/db"}, {"action": "ScaleApplication", "app": "/product/web"}]}
+			]
+		},
+		"currentStep": {"actions": [{"action": "StartApplication", "app": "/product/db"}]}
+	}`))
+	assert.Nil(t, err)
+	assert.False(t, event.Finished())
+
+	deployment := event.Deployment()
+	assert.Equal(t, "867ed450-f6a8-4d33-9b0e-e11c5513990b", deployment.ID)
+	assert.Equal(t, []string{"/product/db", "/product/web"}, deployment.AffectedApps)
+	assert.Equal(t, 1, deployment.CurrentStep)
+	assert.Equal(t, 2, deployment.TotalSteps)
+	assert.Equal(t, "StartApplication", deployment.CurrentActions[0].Action)
+	assert.Equal(t, deployments.StepSucceeded, deployment.Status)
+	assert.Equal(t, "_deployments/867ed450-f6a8-4d33-9b0e-e11c5513990b", deployment.Key())
+}
+
+func TestDeploymentEventOldStep(t *testing.T) {
+	t.Parallel()
+
+	event, err := ParseDeploymentEvent([]byte(`{
+		"eventType": "deployment_info",
+		"plan": {"id": "abc", "steps": [{"action": "ScaleApplication", "app": "/web"}]},
+		"currentStep": {"action": "ScaleApplication", "app": "/web"}
+	}`))
+	assert.Nil(t, err)
+
+	deployment := event.Deployment()
+	assert.Equal(t, []string{"/web"}, deployment.AffectedApps)
+	assert.Equal(t, 1, deployment.CurrentStep)
+	assert.Equal(t, deployments.Running, deployment.Status)
+}
+
+func TestDeploymentEventFinished(t *testing.T) {
+	t.Parallel()
+
+	event, err := ParseDeploymentEvent([]byte(`{"eventType": "deployment_success", "id": "abc"}`))
+	assert.Nil(t, err)
+	assert.True(t, event.Finished())
+	assert.Equal(t, "abc", event.Deployment().ID)
+}
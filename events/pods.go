@@ -0,0 +1,55 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// PodEvent is any of pod_created_event, pod_updated_event and
+// pod_deleted_event. They only carry the URI of the pod, not its definition.
+type PodEvent struct {
+	Type      string `json:"eventType"`
+	URI       string `json:"uri"`
+	Timestamp string `json:"timestamp"`
+}
+
+// PodID returns the ID of the pod the event is about
+func (event PodEvent) PodID() string {
+	return strings.TrimPrefix(event.URI, "/v2/pods")
+}
+
+func (event PodEvent) GetType() string {
+	return event.Type
+}
+
+// InstanceChangedEvent is sent when an instance of an app or pod changes
+// state
+type InstanceChangedEvent struct {
+	Type           string `json:"eventType"`
+	InstanceID     string `json:"instanceId"`
+	Condition      string `json:"condition"`
+	RunSpecID      string `json:"runSpecId"`
+	RunSpecVersion string `json:"runSpecVersion"`
+	AgentID        string `json:"agentId"`
+	Host           string `json:"host"`
+	Timestamp      string `json:"timestamp"`
+}
+
+func (event InstanceChangedEvent) GetType() string {
+	return event.Type
+}
+
+// ParsePodEvent parses pod_created_event, pod_updated_event and
+// pod_deleted_event
+func ParsePodEvent(jsonBlob []byte) (PodEvent, error) {
+	event := PodEvent{}
+	err := json.Unmarshal(jsonBlob, &event)
+	return event, err
+}
+
+// ParseInstanceChangedEvent parses instance_changed_event
+func ParseInstanceChangedEvent(jsonBlob []byte) (InstanceChangedEvent, error) {
+	event := InstanceChangedEvent{}
+	err := json.Unmarshal(jsonBlob, &event)
+	return event, err
+}
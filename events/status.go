@@ -0,0 +1,49 @@
+package events
+
+import (
+	"encoding/json"
+
+	"github.com/CiscoCloud/marathon-consul/tasks"
+)
+
+// StatusUpdateEvent is sent whenever a task changes state. It carries less
+// than /v2/apps/<id>/tasks does, and calls the task ID "taskId".
+type StatusUpdateEvent struct {
+	Type        string            `json:"eventType"`
+	Timestamp   string            `json:"timestamp"`
+	SlaveID     string            `json:"slaveId"`
+	TaskID      string            `json:"taskId"`
+	TaskStatus  string            `json:"taskStatus"`
+	Message     string            `json:"message"`
+	AppID       string            `json:"appId"`
+	Host        string            `json:"host"`
+	IPAddresses []tasks.IPAddress `json:"ipAddresses"`
+	Ports       []int             `json:"ports"`
+	Version     string            `json:"version"`
+}
+
+func (event StatusUpdateEvent) GetType() string {
+	return event.Type
+}
+
+// Task returns the task as far as the event describes it
+func (event StatusUpdateEvent) Task() *tasks.Task {
+	return &tasks.Task{
+		Timestamp:   event.Timestamp,
+		SlaveID:     event.SlaveID,
+		ID:          event.TaskID,
+		TaskStatus:  event.TaskStatus,
+		AppID:       event.AppID,
+		Host:        event.Host,
+		IPAddresses: event.IPAddresses,
+		Ports:       event.Ports,
+		Version:     event.Version,
+	}
+}
+
+// ParseStatusUpdateEvent parses status_update_event
+func ParseStatusUpdateEvent(jsonBlob []byte) (StatusUpdateEvent, error) {
+	event := StatusUpdateEvent{}
+	err := json.Unmarshal(jsonBlob, &event)
+	return event, err
+}
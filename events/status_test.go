@@ -0,0 +1,34 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusUpdateEventTask(t *testing.T) {
+	t.Parallel()
+
+	event, err := ParseStatusUpdateEvent([]byte(`{
+		"eventType": "status_update_event",
+		"timestamp": "2014-03-01T23:29:30.158Z",
+		"slaveId": "20140909-054127-177048842-5050-1494-0",
+		"taskId": "my-app_0-1396592784349",
+		"taskStatus": "TASK_RUNNING",
+		"message": "taskId was reconciled",
+		"appId": "/my-app",
+		"host": "slave-1234.acme.org",
+		"ipAddresses": [{"ipAddress": "10.0.0.2", "protocol": "IPv4"}],
+		"ports": [31372],
+		"version": "2014-04-04T06:26:23.051Z"
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "taskId was reconciled", event.Message)
+
+	task := event.Task()
+	assert.Equal(t, "my-app_0-1396592784349", task.ID)
+	assert.Equal(t, "TASK_RUNNING", task.TaskStatus)
+	assert.Equal(t, "/my-app", task.AppID)
+	assert.Equal(t, "10.0.0.2", task.IPAddresses[0].IPAddress)
+	assert.Equal(t, []int{31372}, task.Ports)
+}
@@ -0,0 +1,118 @@
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/utils"
+	"github.com/hashicorp/consul/api"
+)
+
+// KeyPrefix is the subtree groups live in
+const KeyPrefix = "_groups"
+
+// rootKey stands in for the root group's ID, which cleans to nothing
+const rootKey = "_root"
+
+// Group is a Marathon group with the IDs of its direct members, rather than
+// their full definitions
+type Group struct {
+	ID           string   `json:"id"`
+	Version      string   `json:"version"`
+	Apps         []string `json:"apps"`
+	Pods         []string `json:"pods"`
+	Groups       []string `json:"groups"`
+	Dependencies []string `json:"dependencies"`
+	// AppDependencies maps every member app to the absolute IDs of the apps
+	// and groups it depends on
+	AppDependencies map[string][]string `json:"appDependencies"`
+}
+
+func (group *Group) KV() *api.KVPair {
+	serialized, _ := json.Marshal(group)
+
+	return &api.KVPair{
+		Key:   group.Key(),
+		Value: serialized,
+	}
+}
+
+func (group *Group) Key() string {
+	id := utils.CleanID(group.ID)
+	if id == "" {
+		id = rootKey
+	}
+	return fmt.Sprintf("%s/%s", KeyPrefix, id)
+}
+
+// Tree is a group as returned by /v2/groups, with its members embedded
+type Tree struct {
+	ID           string      `json:"id"`
+	Version      string      `json:"version"`
+	Dependencies []string    `json:"dependencies"`
+	Apps         []*apps.App `json:"apps"`
+	Pods         []struct {
+		ID string `json:"id"`
+	} `json:"pods"`
+	Groups []*Tree `json:"groups"`
+}
+
+// ParseGroups parses the group tree returned by /v2/groups into a flat list
+// of groups, the root group first
+func ParseGroups(jsonBlob []byte) ([]*Group, error) {
+	tree := &Tree{}
+	err := json.Unmarshal(jsonBlob, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return tree.Flatten(), nil
+}
+
+// Flatten returns the tree's group and all groups below it
+func (tree *Tree) Flatten() []*Group {
+	group := &Group{
+		ID:              tree.ID,
+		Version:         tree.Version,
+		Apps:            []string{},
+		Pods:            []string{},
+		Groups:          []string{},
+		Dependencies:    resolve(path.Dir(tree.ID), tree.Dependencies),
+		AppDependencies: map[string][]string{},
+	}
+
+	for _, app := range tree.Apps {
+		group.Apps = append(group.Apps, app.ID)
+		group.AppDependencies[app.ID] = resolve(tree.ID, app.Dependencies)
+	}
+	for _, pod := range tree.Pods {
+		group.Pods = append(group.Pods, pod.ID)
+	}
+
+	flat := []*Group{group}
+	for _, subtree := range tree.Groups {
+		group.Groups = append(group.Groups, subtree.ID)
+		flat = append(flat, subtree.Flatten()...)
+	}
+
+	sort.Strings(group.Apps)
+	sort.Strings(group.Pods)
+	sort.Strings(group.Groups)
+	return flat
+}
+
+// resolve makes dependencies relative to base absolute, the way Marathon does
+func resolve(base string, dependencies []string) []string {
+	resolved := make([]string, len(dependencies))
+	for i, dependency := range dependencies {
+		if path.IsAbs(dependency) {
+			resolved[i] = path.Clean(dependency)
+		} else {
+			resolved[i] = path.Join(base, dependency)
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,52 @@
+package groups
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testGroups = []byte(`{
+	"id": "/",
+	"version": "2017-03-01T10:00:00.000Z",
+	"apps": [{"id": "/monitor"}],
+	"groups": [{
+		"id": "/product",
+		"dependencies": ["/infra"],
+		"groups": [{
+			"id": "/product/service",
+			"apps": [
+				{"id": "/product/service/my-app", "dependencies": ["../../db", "/product/service/cache"]},
+				{"id": "/product/service/cache"}
+			]
+		}]
+	}]
+}`)
+
+func TestParseGroups(t *testing.T) {
+	t.Parallel()
+
+	groups, err := ParseGroups(testGroups)
+	assert.Nil(t, err)
+	assert.Len(t, groups, 3)
+
+	root := groups[0]
+	assert.Equal(t, "/", root.ID)
+	assert.Equal(t, []string{"/monitor"}, root.Apps)
+	assert.Equal(t, []string{"/product"}, root.Groups)
+
+	product := groups[1]
+	assert.Equal(t, []string{"/infra"}, product.Dependencies)
+	assert.Equal(t, []string{"/product/service"}, product.Groups)
+
+	service := groups[2]
+	assert.Equal(t, []string{"/product/service/cache", "/product/service/my-app"}, service.Apps)
+	assert.Equal(t, []string{"/db", "/product/service/cache"}, service.AppDependencies["/product/service/my-app"])
+	assert.Equal(t, []string{}, service.AppDependencies["/product/service/cache"])
+}
+
+func TestGroupKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "_groups/_root", (&Group{ID: "/"}).Key())
+	assert.Equal(t, "_groups/product-service", (&Group{ID: "/product/service"}).Key())
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/CiscoCloud/marathon-consul/config"
@@ -12,6 +16,7 @@ import (
 	"github.com/CiscoCloud/marathon-consul/events"
 	"github.com/CiscoCloud/marathon-consul/marathon"
 	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
 	version "github.com/hashicorp/go-version"
 )
 
@@ -19,28 +24,60 @@ const Name = "marathon-consul"
 const Version = "0.2.0"
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts the bridge and returns the process exit status: 0 after a clean
+// shutdown, 1 if startup failed or shutting down didn't finish in time.
+func run() int {
 	config := config.New()
-	apiConfig, err := config.Registry.Config()
+	status := StatusHandler{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	// every stage of shutting down shares one deadline
+	deadline, stop := shutdownDeadline(ctx, config.ShutdownTimeout)
+	defer stop()
+
+	apiConfigs, err := config.Registry.Configs()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Error(err.Error())
+		return 1
 	}
 
-	kv, err := consul.NewKV(apiConfig)
+	store, err := newStore(config, apiConfigs, status)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Error(err.Error())
+		return 1
 	}
 
-	consul := consul.NewConsul(kv, config.Registry.Prefix)
-
 	// set up initial sync
-	remote, err := config.Marathon.NewMarathon()
+	remote, err := config.Marathon.NewMarathon(apiConfigs[0])
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Error(err.Error())
+		return 1
 	}
-	sync := marathon.NewMarathonSync(remote, consul)
-	go sync.Sync()
+	sync := marathon.NewMarathonSync(remote, store)
+	sync.AppVersions = config.AppVersions
+	status["sync"] = sync
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		err := sync.Sync(ctx)
+		if err != nil {
+			log.WithError(err).Error("initial sync failed")
+		}
+	}()
 
-	fh := &ForwardHandler{consul}
+	policy, err := config.TaskPolicy()
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	fh := &ForwardHandler{consul: store, marathon: remote, policy: &policy}
+	go expireMarkedTasks(ctx, store, policy.Grace, config.TaskTombstones)
 
 	v, err := remote.Version()
 	if err != nil {
@@ -49,37 +86,340 @@ func main() {
 	}
 	minVersion, _ := version.NewConstraint(">= 0.9.0")
 
+	failed := false
 	if minVersion.Check(v) {
 		log.WithField("version", v).Info("detected Marathon events endpoint")
-		SubscribeToEventStream(config, remote, fh)
+
+		served := make(chan error, 1)
+		go func() {
+			served <- ServeStatus(ctx, deadline, config, status)
+			// without /health we'd be restarted anyway, so stop cleanly
+			cancel()
+		}()
+
+		err = SubscribeToEventStream(ctx, deadline, remote, fh)
+		if err != nil {
+			log.WithError(err).Error("could not drain event stream")
+			failed = true
+		}
+		if err = <-served; err != nil {
+			log.WithError(err).Error("status server failed")
+			failed = true
+		}
 	} else {
-		log.WithField("version", v).Info("detected old Marathon version -- make sure to set up an eventSubscription for this process")
-		ServeWebhookReceiver(config, fh)
+		log.WithField("version", v).Info("detected old Marathon version -- using an eventSubscription for this process")
+
+		auth, err := newWebhookAuth(config)
+		if err != nil {
+			log.Error(err.Error())
+			return 1
+		}
+		status["webhook"] = auth
+
+		callback := ""
+		kept := make(chan struct{})
+		if config.Web.Subscribe {
+			callback, err = config.Web.CallbackUrl()
+			if err != nil {
+				log.Error(err.Error())
+				return 1
+			}
+			go func() {
+				remote.KeepSubscribed(ctx, callback, subscriptionCheckInterval)
+				close(kept)
+			}()
+		} else {
+			close(kept)
+		}
+
+		err = ServeWebhookReceiver(ctx, deadline, config, auth.Wrap(fh.Handle), status)
+		if err != nil {
+			log.WithError(err).Error("webhook receiver failed")
+			failed = true
+		}
+		cancel()
+
+		// a check still running could subscribe again right after we leave
+		select {
+		case <-kept:
+		case <-deadline.Done():
+			log.Error("event subscription check did not stop in time")
+			failed = true
+		}
+
+		// Marathon shouldn't keep posting events to an address that's gone
+		if callback != "" {
+			log.Info("removing event subscription")
+			err = remote.Unsubscribe(callback)
+			if err != nil {
+				log.WithError(err).Error("could not remove event subscription")
+				failed = true
+			}
+		}
+	}
+
+	// no more events are coming in; let the initial sync notice and finish
+	// writing what's queued before exiting
+	select {
+	case <-synced:
+	case <-deadline.Done():
+		log.Error("initial sync did not stop in time")
+		failed = true
+	}
+
+	if drainer, ok := store.(consul.Drainer); ok {
+		log.Info("draining registry writes")
+		err = drainer.Drain(deadline)
+		if err != nil {
+			log.WithError(err).Error("could not drain registry writes")
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
 	}
+	log.Info("shut down cleanly")
+	return 0
 }
 
-func SubscribeToEventStream(config *config.Config, m marathon.Marathon, fh *ForwardHandler) {
-Reconnect:
+// shutdownDeadline returns a context that's done timeout after ctx is, or
+// when stop is called
+func shutdownDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, stop := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-deadline.Done():
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			stop()
+		case <-deadline.Done():
+		}
+	}()
+	return deadline, stop
+}
+
+// cancelOnSignal cancels the main context when we're asked to stop
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	log.WithField("signal", sig).Info("shutting down")
+	cancel()
+}
+
+// how often to check that our event subscription is still registered
+const subscriptionCheckInterval = time.Minute
+
+func newWebhookAuth(config *config.Config) (*WebhookAuth, error) {
+	username, password, err := config.Web.GetAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	allow, err := config.Web.AllowedNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookAuth{
+		Secret:   config.Web.Secret,
+		Username: username,
+		Password: password,
+		Allow:    allow,
+	}, nil
+}
+
+// newStore connects to every configured registry target. A single target is
+// written to directly; several targets are written to through a Fanout, which
+// also reports per-target health on /status.
+func newStore(config *config.Config, apiConfigs []*api.Config, status StatusHandler) (consul.Store, error) {
+	encoding, err := config.AppEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiConfigs) == 1 {
+		kv, err := consul.NewKV(apiConfigs[0])
+		if err != nil {
+			return nil, err
+		}
+
+		single := consul.NewConsul(kv, config.Registry.Prefix)
+		single.Writer = newWriter(config)
+		single.TombstoneRetention = config.TaskTombstones
+		single.AppEncoding = encoding
+		single.Agents, err = newAgents(config, apiConfigs[0])
+		if err != nil {
+			return nil, err
+		}
+		return &single, nil
+	}
+
+	targets := []*consul.Target{}
+	for _, apiConfig := range apiConfigs {
+		kv, err := consul.NewKV(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		name := apiConfig.Datacenter
+		if name == "" {
+			name = apiConfig.Address
+		}
+		target := consul.NewTarget(name, kv, config.Registry.Prefix)
+		target.SetWriter(newWriter(config))
+		target.SetTombstoneRetention(config.TaskTombstones)
+		target.SetAppEncoding(encoding)
+		agents, err := newAgents(config, apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		target.SetAgents(agents)
+		targets = append(targets, target)
+		log.WithField("target", name).Info("mirroring to registry target")
+	}
+
+	fanout := consul.NewFanout(targets...)
+	status["registry"] = fanout
+	return fanout, nil
+}
+
+// newAgents returns the agents a registry target registers services with, if
+// it does: the agent on each task's host with RegisterAgent, or the registry
+// agent itself
+func newAgents(config *config.Config, apiConfig *api.Config) (*consul.Agents, error) {
+	if !config.RegisterServices {
+		return nil, nil
+	}
+
+	if config.RegisterAgent != "" {
+		return consul.NewLocalAgents(config.RegisterAgent, apiConfig)
+	}
+
+	agent, err := consul.NewAgent(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+	return consul.CentralAgent(agent), nil
+}
+
+// how often to look for tasks that have been marked, or tombstones that have
+// been kept, for too long
+const expireInterval = time.Minute
+
+// expireMarkedTasks removes tasks that have been marked for longer than grace,
+// and tombstones older than retention if there are any, until ctx is cancelled
+func expireMarkedTasks(ctx context.Context, store consul.Store, grace, retention time.Duration) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
 	for {
-		resp, err := makeEventStreamRequest(m.Url("/v2/events"))
-		defer resp.Body.Close()
-		reader := bufio.NewReader(resp.Body)
-		log.Info("connected to /v2/events endpoint")
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := store.ExpireTasks(time.Now().Add(-grace))
+			if err != nil {
+				log.WithError(err).Error("could not expire marked tasks")
+			}
+
+			if retention == 0 {
+				continue
+			}
+			err = store.ExpireTombstones(time.Now().Add(-retention))
+			if err != nil {
+				log.WithError(err).Error("could not expire task tombstones")
+			}
+		}
+	}
+}
+
+// newWriter limits how hard a sync hits a registry target. Every target gets
+// its own, so a slow datacenter doesn't eat into the others' rate.
+func newWriter(config *config.Config) *consul.Writer {
+	return consul.NewWriter(config.Registry.Concurrency, config.Registry.RateLimit)
+}
+
+// how often to check whether the Marathon leader has moved while connected to
+// the event stream
+const leaderPollInterval = 30 * time.Second
+
+// how many events read from the stream may wait to be handled
+const eventQueueSize = 1024
+
+var ErrDrainTimeout = errors.New("events were still queued at the shutdown deadline")
+
+// SubscribeToEventStream reads Marathon's event stream until ctx is cancelled,
+// then handles the events already read before returning, unless deadline is
+// done first.
+func SubscribeToEventStream(ctx, deadline context.Context, m marathon.Marathon, fh *ForwardHandler) error {
+	queue := make(chan []byte, eventQueueSize)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for body := range queue {
+			handleStreamEvent(fh, body)
+		}
+	}()
+
+	readEventStream(ctx, m, queue)
+	close(queue)
+
+	log.WithField("queued", len(queue)).Info("draining queued events")
+	select {
+	case <-handled:
+		return nil
+	case <-deadline.Done():
+		return ErrDrainTimeout
+	}
+}
+
+// readEventStream queues the data of every event read from the leader's event
+// stream, reconnecting whenever the connection is lost, until ctx is
+// cancelled
+func readEventStream(ctx context.Context, m marathon.Marathon, queue chan<- []byte) {
+Reconnect:
+	for ctx.Err() == nil {
+		// the event stream is only complete on the leader, so connect there
+		// directly when we can find it
+		leader, err := m.Leader()
+		if err != nil {
+			log.WithError(err).Warn("could not find Marathon leader, connecting to current location")
+			leader = m.Location()
+		}
 
+		resp, err := m.EventStream(leader)
 		if err != nil {
 			log.WithError(err).Error("error connecting to event stream!")
-			time.Sleep(10 * time.Second)
-			log.Info("reconnecting...")
+			waitToReconnect(ctx)
 			continue Reconnect
 		}
+		log.WithField("leader", leader).Info("connected to /v2/events endpoint")
+
+		stop := make(chan struct{})
+		go watchLeader(ctx, m, leader, resp, stop)
+		reader := bufio.NewReader(resp.Body)
 
 		for {
 			body, err := reader.ReadBytes('\n')
 
 			if err != nil {
+				close(stop)
+				resp.Body.Close()
+				if ctx.Err() != nil {
+					return
+				}
+
 				log.WithError(err).Error("error reading from event stream!")
-				time.Sleep(10 * time.Second)
-				log.Info("reconnecting...")
+				waitToReconnect(ctx)
 				continue Reconnect
 			}
 
@@ -90,64 +430,129 @@ Reconnect:
 
 			// we don't care about these headers, since the data blob has an
 			// "eventType" field
-			if string(body[0:6]) == "event:" {
+			if bytes.HasPrefix(body, []byte("event:")) {
 				continue
 			}
 
-			if string(body[0:5]) == "data:" {
-				body = body[6:]
-				eventType, err := events.EventType(body)
-				if err != nil {
-					log.WithError(err).Error("error parsing event")
-					continue
-				}
-
-				eventLogger := log.WithField("eventType", eventType)
-				switch eventType {
-				case "api_post_event", "deployment_info":
-					eventLogger.Info("handling event")
-					err = fh.HandleAppEvent(body)
-				case "app_terminated_event":
-					eventLogger.Info("handling event")
-					err = fh.HandleTerminationEvent(body)
-				case "status_update_event":
-					eventLogger.Info("handling event")
-					err = fh.HandleStatusEvent(body)
-				default:
-					eventLogger.Info("not handling event")
-				}
-
-				if err != nil {
-					eventLogger.WithError(err).Error("body generated error")
-					continue
-				}
+			if bytes.HasPrefix(body, []byte("data:")) {
+				queue <- body[6:]
 			}
 		}
 	}
 }
 
-func ServeWebhookReceiver(config *config.Config, fh *ForwardHandler) {
-	http.HandleFunc("/health", HealthHandler)
-	http.HandleFunc("/events", fh.Handle)
-
-	log.WithField("port", config.Web.Listen).Info("listening")
-	log.Fatal(http.ListenAndServe(config.Web.Listen, nil))
+func waitToReconnect(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		log.Info("reconnecting...")
+	}
 }
 
-func makeEventStreamRequest(url string) (*http.Response, error) {
-	buffer := make([]byte, 1024)
-	req, err := http.NewRequest("GET", url, bytes.NewBuffer(buffer))
+func handleStreamEvent(fh *ForwardHandler, body []byte) {
+	eventType, err := events.EventType(body)
 	if err != nil {
-		log.WithError(err).Error("Could not GET /v2/events")
-		os.Exit(1)
+		log.WithError(err).Error("error parsing event")
+		return
 	}
-	req.Header.Set("Accept", "text/event-stream")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+
+	eventLogger := log.WithField("eventType", eventType)
+	switch eventType {
+	case "api_post_event":
+		eventLogger.Info("handling event")
+		err = fh.HandleAppEvent(body)
+	case "deployment_info":
+		eventLogger.Info("handling event")
+		err = fh.HandleAppEvent(body)
+		if err == nil {
+			err = fh.HandleDeploymentEvent(body)
+		}
+	case "deployment_success", "deployment_failed", "deployment_step_success", "deployment_step_failure":
+		eventLogger.Info("handling event")
+		err = fh.HandleDeploymentEvent(body)
+	case "app_terminated_event":
+		eventLogger.Info("handling event")
+		err = fh.HandleTerminationEvent(body)
+	case "status_update_event":
+		eventLogger.Info("handling event")
+		err = fh.HandleStatusEvent(body)
+	case "group_change_success":
+		eventLogger.Info("handling event")
+		err = fh.HandleGroupChangeEvent(body)
+	case "pod_created_event", "pod_updated_event", "pod_deleted_event":
+		eventLogger.Info("handling event")
+		err = fh.HandlePodEvent(body)
+	case "instance_changed_event":
+		eventLogger.Info("handling event")
+		err = fh.HandleInstanceChangedEvent(body)
+	default:
+		eventLogger.Info("not handling event")
+	}
+
 	if err != nil {
-		log.WithError(err).Error("HTTP request for /v2/events failed!")
-		return nil, err
+		eventLogger.WithError(err).Error("body generated error")
+	}
+}
+
+// watchLeader closes the event stream when Marathon's leadership moves away
+// from leader, so that readEventStream reconnects to the new leader, or when
+// ctx is cancelled, so that it stops.
+func watchLeader(ctx context.Context, m marathon.Marathon, leader string, resp *http.Response, stop chan struct{}) {
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			resp.Body.Close()
+			return
+		case <-ticker.C:
+			current, err := m.Leader()
+			if err != nil || current == leader {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"from": leader,
+				"to":   current,
+			}).Info("Marathon leader changed, moving event stream")
+			resp.Body.Close()
+			return
+		}
+	}
+}
+
+func ServeWebhookReceiver(ctx, deadline context.Context, config *config.Config, events http.HandlerFunc, status StatusHandler) error {
+	http.HandleFunc("/events", events)
+	return ServeStatus(ctx, deadline, config, status)
+}
+
+// ServeStatus serves /health and /status (and anything else registered on the
+// default mux) until ctx is cancelled, then waits for requests in flight to
+// finish, unless deadline is done first.
+func ServeStatus(ctx, deadline context.Context, config *config.Config, status StatusHandler) error {
+	http.HandleFunc("/health", HealthHandler)
+	http.Handle("/status", status)
+
+	server := &http.Server{Addr: config.Web.Listen}
+	served := make(chan error, 1)
+	go func() {
+		if config.Web.CertFile != "" {
+			log.WithField("port", config.Web.Listen).Info("listening with TLS")
+			served <- server.ListenAndServeTLS(config.Web.CertFile, config.Web.KeyFile)
+		} else {
+			log.WithField("port", config.Web.Listen).Info("listening")
+			served <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
 	}
 
-	return resp, nil
+	return server.Shutdown(deadline)
 }
@@ -0,0 +1,219 @@
+package marathon
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrNoPrivateKey = errors.New("service account has no usable RSA private key")
+	ErrNoToken      = errors.New("login response did not contain a token")
+)
+
+// TokenSource provides DC/OS ACS tokens for Marathon requests
+type TokenSource interface {
+	Token() (string, error)
+	// Invalidate is called when Marathon rejects a token
+	Invalidate()
+}
+
+// StaticToken is a fixed token, e.g. from `dcos config show core.dcos_acs_token`
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+func (t StaticToken) Invalidate() {}
+
+// how long a login JWT is valid for, and how long before its expiry a token
+// is refreshed
+const (
+	loginTokenLifetime = 5 * time.Minute
+	tokenRefreshMargin = 5 * time.Minute
+	defaultTokenExpiry = time.Hour
+)
+
+// ServiceAccount logs in to DC/OS with a service account's private key and
+// caches the resulting token until shortly before it expires.
+type ServiceAccount struct {
+	UID           string       `json:"uid"`
+	LoginEndpoint string       `json:"login_endpoint"`
+	PrivateKeyPEM string       `json:"private_key"`
+	Client        *http.Client `json:"-"`
+
+	key     *rsa.PrivateKey
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// ParseServiceAccount parses a DC/OS service account secret, as created with
+// `dcos security secrets create-sa-secret`
+func ParseServiceAccount(jsonBlob []byte) (*ServiceAccount, error) {
+	account := &ServiceAccount{Client: &http.Client{}}
+	err := json.Unmarshal(jsonBlob, account)
+	if err != nil {
+		return nil, err
+	}
+
+	account.key, err = parsePrivateKey([]byte(account.PrivateKeyPEM))
+	return account, err
+}
+
+func parsePrivateKey(pemBlob []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBlob)
+	if block == nil {
+		return nil, ErrNoPrivateKey
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrNoPrivateKey
+	}
+	return rsaKey, nil
+}
+
+func (sa *ServiceAccount) Token() (string, error) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	if sa.token != "" && time.Now().Add(tokenRefreshMargin).Before(sa.expires) {
+		return sa.token, nil
+	}
+
+	token, err := sa.login()
+	if err != nil {
+		return "", err
+	}
+
+	sa.token = token
+	sa.expires = tokenExpiry(token)
+	log.WithFields(log.Fields{
+		"uid":     sa.UID,
+		"expires": sa.expires,
+	}).Info("logged in to DC/OS")
+
+	return sa.token, nil
+}
+
+func (sa *ServiceAccount) Invalidate() {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	sa.token = ""
+}
+
+type loginRequest struct {
+	UID   string `json:"uid"`
+	Token string `json:"token"`
+}
+
+type loginResponse struct {
+	Token string `json:"token"`
+}
+
+func (sa *ServiceAccount) login() (string, error) {
+	loginToken, err := sa.signLoginToken()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(loginRequest{sa.UID, loginToken})
+	if err != nil {
+		return "", err
+	}
+
+	response, err := sa.Client.Post(sa.LoginEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return "", fmt.Errorf("login as %s failed with status code %d", sa.UID, response.StatusCode)
+	}
+
+	login := &loginResponse{}
+	err = json.NewDecoder(response.Body).Decode(login)
+	if err != nil {
+		return "", err
+	}
+	if login.Token == "" {
+		return "", ErrNoToken
+	}
+
+	return login.Token, nil
+}
+
+// signLoginToken creates the short-lived RS256 JWT the login endpoint expects
+func (sa *ServiceAccount) signLoginToken() (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"uid": sa.UID,
+		"exp": time.Now().Add(loginTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// tokenExpiry reads the expiry out of a token's (unverified) claims, falling
+// back to a conservative default when it can't be read
+func tokenExpiry(token string) time.Time {
+	fallback := time.Now().Add(defaultTokenExpiry)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return fallback
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,109 @@
+package marathon
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizeBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewMarathon("localhost:8080", "http", url.UserPassword("user", "secret"))
+	request, err := m.newRequest("GET", "localhost:8080", "/v2/apps", nil, "application/json")
+	assert.Nil(t, err)
+
+	// credentials go in the header, never in the (loggable) URL
+	assert.Equal(t, "http://localhost:8080/v2/apps", request.URL.String())
+	username, password, ok := request.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "secret", password)
+
+	// empty credentials are not sent at all
+	m, _ = NewMarathon("localhost:8080", "http", url.UserPassword("", ""))
+	request, err = m.newRequest("GET", "localhost:8080", "/v2/apps", nil, "application/json")
+	assert.Nil(t, err)
+	assert.Equal(t, "", request.Header.Get("Authorization"))
+}
+
+func TestAuthorizeToken(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewMarathon("localhost:8080", "http", nil)
+	m.Token = StaticToken("abc")
+
+	request, err := m.newRequest("GET", "localhost:8080", "/v2/apps", nil, "application/json")
+	assert.Nil(t, err)
+	assert.Equal(t, "token=abc", request.Header.Get("Authorization"))
+}
+
+func TestServiceAccountLogin(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+
+	logins := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins++
+
+		login := loginRequest{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&login))
+		assert.Equal(t, "marathon-consul", login.UID)
+
+		// the login token must be signed with the service account's key
+		parts := strings.Split(login.Token, ".")
+		if assert.Len(t, parts, 3) {
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+		}
+
+		fmt.Fprintf(w, `{"token": "token-%d"}`, logins)
+	}))
+	defer server.Close()
+
+	secret, _ := json.Marshal(map[string]string{
+		"uid":            "marathon-consul",
+		"login_endpoint": server.URL + "/acs/api/v1/auth/login",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+	})
+	account, err := ParseServiceAccount(secret)
+	assert.Nil(t, err)
+
+	token, err := account.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// cached until invalidated
+	token, _ = account.Token()
+	assert.Equal(t, "token-1", token)
+
+	account.Invalidate()
+	token, _ = account.Token()
+	assert.Equal(t, "token-2", token)
+}
+
+func TestParseServiceAccountBadKey(t *testing.T) {
+	t.Parallel()
+
+	_, err := ParseServiceAccount([]byte(`{"uid": "x", "private_key": "nope"}`))
+	assert.Equal(t, ErrNoPrivateKey, err)
+}
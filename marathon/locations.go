@@ -0,0 +1,69 @@
+package marathon
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Resolver looks up the current set of Marathon masters, e.g. from the Consul
+// catalog
+type Resolver func() ([]string, error)
+
+// locations is the set of Marathon masters a Marathon fails over between. It
+// is shared between copies of a Marathon.
+type locations struct {
+	lock    sync.RWMutex
+	all     []string
+	active  int
+	resolve Resolver
+}
+
+func (l *locations) current() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.all[l.active]
+}
+
+func (l *locations) list() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return append([]string{}, l.all...)
+}
+
+// failover moves on to the next location, unless another request already
+// failed over away from `from`. Resolved locations are looked up again first,
+// since the failed master has most likely moved.
+func (l *locations) failover(from string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.all[l.active] != from {
+		return
+	}
+
+	if l.resolve != nil {
+		resolved, err := l.resolve()
+		if err != nil || len(resolved) == 0 {
+			log.WithError(err).Warn("could not re-resolve Marathon locations, keeping the old ones")
+		} else {
+			l.all = resolved
+			l.active = -1
+			for i, location := range resolved {
+				if location == from {
+					l.active = i
+				}
+			}
+		}
+	}
+
+	l.active = (l.active + 1) % len(l.all)
+	if l.all[l.active] != from {
+		log.WithFields(log.Fields{
+			"from": from,
+			"to":   l.all[l.active],
+		}).Warn("failing over to next Marathon location")
+	}
+}
@@ -3,12 +3,18 @@ package marathon
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/CiscoCloud/marathon-consul/pods"
 	"github.com/CiscoCloud/marathon-consul/tasks"
 	log "github.com/Sirupsen/logrus"
 	version "github.com/hashicorp/go-version"
@@ -16,70 +22,273 @@ import (
 )
 
 type Marathoner interface {
+	Version() (*version.Version, error)
 	Apps() ([]*apps.App, error)
+	AppsWithTasks() ([]*apps.App, map[string][]*tasks.Task, error)
+	AppVersions(string) ([]string, error)
+	AppVersion(string, string) (*apps.App, error)
 	Tasks(string) ([]*tasks.Task, error)
+	PodStatuses() ([]*pods.Status, error)
+	PodStatus(string) (*pods.Status, error)
+	Deployments() ([]*deployments.Deployment, error)
+	Groups() ([]*groups.Group, error)
 }
 
 type Marathon struct {
-	Location    string
 	Protocol    string
 	Auth        *url.Userinfo
 	NoVerifySsl bool
+	// TLSConfig, if set, is used for all connections instead of one built
+	// from NoVerifySsl, e.g. to present a client certificate
+	TLSConfig *tls.Config
+	// Token, if set, authenticates requests with a DC/OS ACS token instead
+	// of basic auth
+	Token     TokenSource
+	locations *locations
 }
 
+// BulkTasksVersion is the first Marathon version that embeds tasks in
+// /v2/apps
+const BulkTasksVersion = ">= 0.8.0"
+
+var (
+	ErrNoLocation = errors.New("please specify at least one Marathon location")
+	ErrNoLeader   = errors.New("Marathon reported no leader")
+	// ErrNotFound is returned for a 404, e.g. for a pod that is really an
+	// app, or for pods on a Marathon older than 1.4
+	ErrNotFound = errors.New("not found")
+)
+
+// NewMarathon creates a Marathon client. location may be a comma-separated
+// list of Marathon masters, which are failed over between in order.
 func NewMarathon(location, protocol string, auth *url.Userinfo) (Marathon, error) {
-	return Marathon{location, protocol, auth, false}, nil
+	all := []string{}
+	for _, l := range strings.Split(location, ",") {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			all = append(all, l)
+		}
+	}
+	if len(all) == 0 {
+		return Marathon{}, ErrNoLocation
+	}
+
+	return Marathon{
+		Protocol:  protocol,
+		Auth:      auth,
+		locations: &locations{all: all},
+	}, nil
+}
+
+// NewResolvedMarathon creates a Marathon client whose masters are looked up
+// with resolve, both now and whenever the current master stops responding.
+func NewResolvedMarathon(resolve Resolver, protocol string, auth *url.Userinfo) (Marathon, error) {
+	all, err := resolve()
+	if err != nil {
+		return Marathon{}, err
+	}
+	if len(all) == 0 {
+		return Marathon{}, ErrNoLocation
+	}
+
+	return Marathon{
+		Protocol:  protocol,
+		Auth:      auth,
+		locations: &locations{all: all, resolve: resolve},
+	}, nil
+}
+
+// Location returns the Marathon master currently in use
+func (m Marathon) Location() string {
+	return m.locations.current()
 }
 
+// Locations returns every known Marathon master
+func (m Marathon) Locations() []string {
+	return m.locations.list()
+}
+
+// Url builds a URL for path against the Marathon master currently in use
 func (m Marathon) Url(path string) string {
+	return m.LocationUrl(m.Location(), path)
+}
+
+// LocationUrl builds a URL for path against a specific Marathon master.
+// Credentials are never part of the URL (see authorize), so it is safe to log.
+func (m Marathon) LocationUrl(location, path string) string {
 	marathon := url.URL{
 		Scheme: m.Protocol,
-		User:   m.Auth,
-		Host:   m.Location,
+		Host:   location,
 		Path:   path,
 	}
 
 	return marathon.String()
 }
 
-func (m Marathon) getClient() *pester.Client {
-	client := pester.New()
-	client.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{
+func (m Marathon) transport() *http.Transport {
+	tlsConfig := m.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
 			InsecureSkipVerify: m.NoVerifySsl,
-		},
+		}
+	}
+
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
 	}
+}
+
+func (m Marathon) getClient() *pester.Client {
+	client := pester.New()
+	client.Transport = m.transport()
 
 	return client
 }
 
-func (m Marathon) Apps() ([]*apps.App, error) {
-	log.WithField("location", m.Location).Debug("asking Marathon for apps")
+// authorize adds credentials to a request: a DC/OS token if there is a token
+// source, basic auth otherwise
+func (m Marathon) authorize(request *http.Request) error {
+	if m.Token != nil {
+		token, err := m.Token.Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "token="+token)
+		return nil
+	}
+
+	if m.Auth != nil && m.Auth.Username() != "" {
+		password, _ := m.Auth.Password()
+		request.SetBasicAuth(m.Auth.Username(), password)
+	}
+	return nil
+}
+
+// newRequest creates an authorized request for path on location
+func (m Marathon) newRequest(method, location, path string, query url.Values, accept string) (*http.Request, error) {
+	target := m.LocationUrl(location, path)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Accept", accept)
+
+	return request, m.authorize(request)
+}
+
+func (m Marathon) get(path string) ([]byte, error) {
+	return m.do("GET", path, nil)
+}
+
+// do sends a request for path to the current Marathon master and returns the
+// response body. Connection errors and server errors fail over to the next
+// master until every master has been tried once. A rejected token is
+// refreshed and retried once.
+func (m Marathon) do(method, path string, query url.Values) ([]byte, error) {
 	client := m.getClient()
+	refreshed := false
+
+	var err error
+	for attempt := 0; attempt < len(m.Locations()); attempt++ {
+		location := m.Location()
+
+		var request *http.Request
+		request, err = m.newRequest(method, location, path, query, "application/json")
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+
+		var response *http.Response
+		response, err = client.Do(request)
+		if urlErr, ok := err.(*url.Error); ok {
+			// the query may hold secrets (e.g. an event subscription's
+			// callback URL), which callers log
+			err = &url.Error{Op: urlErr.Op, URL: m.LocationUrl(location, path), Err: urlErr.Err}
+		}
+		if err == nil && response.StatusCode == 404 {
+			response.Body.Close()
+			log.WithFields(log.Fields{
+				"location": location,
+				"path":     path,
+			}).Debug("not found")
+			return nil, ErrNotFound
+		}
+		if err == nil && response.StatusCode != 200 {
+			err = fmt.Errorf("unexpected status code %d for %s", response.StatusCode, path)
+		}
+		if err != nil {
+			m.logHTTPError(location, response, err)
+			if response != nil {
+				response.Body.Close()
+				if response.StatusCode == 401 && m.Token != nil && !refreshed {
+					m.Token.Invalidate()
+					refreshed = true
+					attempt--
+					continue
+				}
+				if response.StatusCode < 500 {
+					return nil, err
+				}
+			}
+			m.locations.failover(location)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			m.logHTTPError(location, response, err)
+		}
+		return body, err
+	}
 
-	request, err := http.NewRequest("GET", m.Url("/v2/apps"), nil)
+	return nil, err
+}
+
+// EventStream opens the server-sent event stream on a specific Marathon
+// master, with the same transport and credentials as every other request
+func (m Marathon) EventStream(location string) (*http.Response, error) {
+	request, err := m.newRequest("GET", location, "/v2/events", nil, "text/event-stream")
 	if err != nil {
-		log.Error(err.Error())
 		return nil, err
 	}
-	request.Header.Add("Accept", "application/json")
 
-	appsResponse, err := client.Do(request)
-	if err != nil || (appsResponse.StatusCode != 200) {
-		m.logHTTPError(appsResponse, err)
+	client := &http.Client{Transport: m.transport()}
+	response, err := client.Do(request)
+	if err != nil {
+		m.logHTTPError(location, response, err)
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		response.Body.Close()
+		if response.StatusCode == 401 && m.Token != nil {
+			m.Token.Invalidate()
+		}
+		err = fmt.Errorf("unexpected status code %d for /v2/events", response.StatusCode)
+		m.logHTTPError(location, response, err)
 		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(appsResponse.Body)
+	return response, nil
+}
+
+func (m Marathon) Apps() ([]*apps.App, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for apps")
+
+	body, err := m.get("/v2/apps")
 	if err != nil {
-		m.logHTTPError(appsResponse, err)
 		return nil, err
 	}
 
 	appList, err := m.ParseApps(body)
 	if err != nil {
-		m.logHTTPError(appsResponse, err)
+		log.WithError(err).Error("could not parse apps")
 	}
 
 	return appList, err
@@ -96,38 +305,135 @@ func (m Marathon) ParseApps(jsonBlob []byte) ([]*apps.App, error) {
 	return apps.Apps, err
 }
 
-func (m Marathon) Version() (*version.Version, error) {
-	log.WithField("location", m.Location).Debug("asking Marathon for its version")
-	client := m.getClient()
+// AppsWithTasks fetches every app together with its tasks in a single request,
+// keyed by app ID. Marathons older than BulkTasksVersion can't do this; use
+// Apps and Tasks instead. Apps Marathon didn't embed tasks in are left out
+// of the map, so they can be told apart from apps without tasks.
+func (m Marathon) AppsWithTasks() ([]*apps.App, map[string][]*tasks.Task, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for apps with tasks")
+
+	body, err := m.do("GET", "/v2/apps", url.Values{"embed": {"apps.tasks"}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appList, appTasks, err := m.ParseAppsWithTasks(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse apps")
+	}
+
+	return appList, appTasks, err
+}
+
+type AppTasksResponse struct {
+	Apps []struct {
+		ID    string        `json:"id"`
+		// Tasks is nil if Marathon didn't embed them
+		Tasks *[]*tasks.Task `json:"tasks"`
+	} `json:"apps"`
+}
+
+func (m Marathon) ParseAppsWithTasks(jsonBlob []byte) ([]*apps.App, map[string][]*tasks.Task, error) {
+	appList, err := m.ParseApps(jsonBlob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	embedded := &AppTasksResponse{}
+	err = json.Unmarshal(jsonBlob, embedded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appTasks := make(map[string][]*tasks.Task, len(embedded.Apps))
+	for _, app := range embedded.Apps {
+		if app.Tasks != nil {
+			appTasks[app.ID] = *app.Tasks
+		}
+	}
+
+	return appList, appTasks, nil
+}
+
+// AppVersions lists the versions Marathon keeps of an app's definition
+func (m Marathon) AppVersions(app string) ([]string, error) {
+	log.WithFields(log.Fields{
+		"location": m.Location(),
+		"app":      app,
+	}).Debug("asking Marathon for app versions")
+
+	if app[0] == '/' {
+		app = app[1:]
+	}
+
+	body, err := m.get(fmt.Sprintf("/v2/apps/%s/versions", app))
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := m.ParseAppVersions(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse app versions")
+	}
+
+	return versions, err
+}
+
+type AppVersionsResponse struct {
+	Versions []string `json:"versions"`
+}
+
+func (m Marathon) ParseAppVersions(jsonBlob []byte) ([]string, error) {
+	versions := &AppVersionsResponse{}
+	err := json.Unmarshal(jsonBlob, versions)
+
+	return versions.Versions, err
+}
+
+// AppVersion returns an app's definition as it was at version
+func (m Marathon) AppVersion(app, version string) (*apps.App, error) {
+	log.WithFields(log.Fields{
+		"location": m.Location(),
+		"app":      app,
+		"version":  version,
+	}).Debug("asking Marathon for app version")
 
-	request, err := http.NewRequest("GET", m.Url("/v2/info"), nil)
+	if app[0] == '/' {
+		app = app[1:]
+	}
+
+	body, err := m.get(fmt.Sprintf("/v2/apps/%s/versions/%s", app, version))
 	if err != nil {
-		log.Error(err.Error())
 		return nil, err
 	}
-	request.Header.Add("Accept", "application/json")
 
-	infoResponse, err := client.Do(request)
-	if err != nil || (infoResponse.StatusCode != 200) {
-		m.logHTTPError(infoResponse, err)
+	definition := &apps.App{}
+	err = json.Unmarshal(body, definition)
+	if err != nil {
+		log.WithError(err).Error("could not parse app version")
 		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(infoResponse.Body)
+	return definition, nil
+}
+
+func (m Marathon) Version() (*version.Version, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for its version")
+
+	body, err := m.get("/v2/info")
 	if err != nil {
-		m.logHTTPError(infoResponse, err)
 		return nil, err
 	}
 
 	v, err := m.ParseVersion(body)
 	if err != nil {
-		m.logHTTPError(infoResponse, err)
+		log.WithError(err).Error("could not parse info")
 		return nil, err
 	}
 
 	parsedVersion, err := version.NewVersion(v)
 	if err != nil {
-		log.WithError(err).Error("error parsing version: %s", v)
+		log.WithError(err).Errorf("error parsing version: %s", v)
 		return nil, err
 	}
 
@@ -144,39 +450,55 @@ func (m Marathon) ParseVersion(resp []byte) (string, error) {
 	return info.Version, err
 }
 
+// Leader asks Marathon which master is currently the leader and returns its
+// host:port
+func (m Marathon) Leader() (string, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for its leader")
+
+	body, err := m.get("/v2/leader")
+	if err != nil {
+		return "", err
+	}
+
+	leader, err := m.ParseLeader(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse leader")
+	}
+
+	return leader, err
+}
+
+type LeaderResponse struct {
+	Leader string `json:"leader"`
+}
+
+func (m Marathon) ParseLeader(resp []byte) (string, error) {
+	leader := &LeaderResponse{}
+	err := json.Unmarshal(resp, leader)
+	if err == nil && leader.Leader == "" {
+		err = ErrNoLeader
+	}
+	return leader.Leader, err
+}
+
 func (m Marathon) Tasks(app string) ([]*tasks.Task, error) {
 	log.WithFields(log.Fields{
-		"location": m.Location,
+		"location": m.Location(),
 		"app":      app,
 	}).Debug("asking Marathon for tasks")
-	client := m.getClient()
 
 	if app[0] == '/' {
 		app = app[1:]
 	}
 
-	request, err := http.NewRequest("GET", m.Url(fmt.Sprintf("/v2/apps/%s/tasks", app)), nil)
+	body, err := m.get(fmt.Sprintf("/v2/apps/%s/tasks", app))
 	if err != nil {
-		log.Error(err.Error())
-		return nil, err
-	}
-	request.Header.Add("Accept", "application/json")
-
-	tasksResponse, err := client.Do(request)
-	if err != nil || (tasksResponse.StatusCode != 200) {
-		m.logHTTPError(tasksResponse, err)
-		return nil, err
-	}
-
-	body, err := ioutil.ReadAll(tasksResponse.Body)
-	if err != nil {
-		m.logHTTPError(tasksResponse, err)
 		return nil, err
 	}
 
 	taskList, err := m.ParseTasks(body)
 	if err != nil {
-		m.logHTTPError(tasksResponse, err)
+		log.WithError(err).Error("could not parse tasks")
 	}
 
 	return taskList, err
@@ -193,14 +515,96 @@ func (m Marathon) ParseTasks(jsonBlob []byte) ([]*tasks.Task, error) {
 	return tasks.Tasks, err
 }
 
-func (m Marathon) logHTTPError(resp *http.Response, err error) {
+// PodStatuses returns every pod together with its instances
+func (m Marathon) PodStatuses() ([]*pods.Status, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for pods")
+
+	body, err := m.get("/v2/pods/::status")
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := pods.ParseStatuses(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse pods")
+	}
+
+	return statuses, err
+}
+
+// PodStatus returns a single pod together with its instances. It returns
+// ErrNotFound if there is no such pod.
+func (m Marathon) PodStatus(pod string) (*pods.Status, error) {
+	log.WithFields(log.Fields{
+		"location": m.Location(),
+		"pod":      pod,
+	}).Debug("asking Marathon for pod")
+
+	if pod[0] == '/' {
+		pod = pod[1:]
+	}
+
+	body, err := m.get(fmt.Sprintf("/v2/pods/%s::status", pod))
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := pods.ParseStatus(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse pod")
+	}
+
+	return status, err
+}
+
+// Deployments returns the deployments in progress
+func (m Marathon) Deployments() ([]*deployments.Deployment, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for deployments")
+
+	body, err := m.get("/v2/deployments")
+	if err != nil {
+		return nil, err
+	}
+
+	deploymentList, err := deployments.ParseDeployments(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse deployments")
+	}
+
+	return deploymentList, err
+}
+
+// Groups returns every group, the root group first
+func (m Marathon) Groups() ([]*groups.Group, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for groups")
+
+	body, err := m.get("/v2/groups")
+	if err != nil {
+		return nil, err
+	}
+
+	groupList, err := groups.ParseGroups(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse groups")
+	}
+
+	return groupList, err
+}
+
+func (m Marathon) logHTTPError(location string, resp *http.Response, err error) {
+	// url.Error includes the full URL, query and all, which may contain
+	// secrets (e.g. an event subscription's callback URL)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
 	var statusCode string = "???"
 	if resp != nil {
-		statusCode = string(resp.StatusCode)
+		statusCode = strconv.Itoa(resp.StatusCode)
 	}
 
 	log.WithFields(log.Fields{
-		"location":   m.Location,
+		"location":   location,
 		"protocol":   m.Protocol,
 		"statusCode": statusCode,
 	}).Error(err)
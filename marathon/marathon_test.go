@@ -1,6 +1,10 @@
 package marathon
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	version "github.com/hashicorp/go-version"
@@ -16,6 +20,95 @@ func TestUrl(t *testing.T) {
 	assert.Equal(t, url, "http://localhost:8080/v2/apps")
 }
 
+func TestNewMarathonLocations(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewMarathon("m1:8080, m2:8080", "http", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m1:8080", "m2:8080"}, m.Locations())
+	assert.Equal(t, "m1:8080", m.Location())
+	assert.Equal(t, "http://m2:8080/v2/events", m.LocationUrl("m2:8080", "/v2/events"))
+
+	_, err = NewMarathon("", "http", nil)
+	assert.Equal(t, ErrNoLocation, err)
+}
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"leader": "up.example.com:8080"}`)
+	}))
+	defer up.Close()
+
+	m, _ := NewMarathon(
+		strings.Join([]string{
+			strings.TrimPrefix(down.URL, "http://"),
+			strings.TrimPrefix(up.URL, "http://"),
+		}, ","),
+		"http",
+		nil,
+	)
+
+	leader, err := m.Leader()
+	assert.Nil(t, err)
+	assert.Equal(t, "up.example.com:8080", leader)
+
+	// we should stay on the working location from now on
+	assert.Equal(t, strings.TrimPrefix(up.URL, "http://"), m.Location())
+}
+
+func TestResolvedFailover(t *testing.T) {
+	t.Parallel()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"leader": "up.example.com:8080"}`)
+	}))
+	defer up.Close()
+
+	// the first lookup only knows about a master that has since gone away
+	resolved := [][]string{
+		{"127.0.0.1:1"},
+		{strings.TrimPrefix(up.URL, "http://")},
+	}
+	resolve := func() ([]string, error) {
+		next := resolved[0]
+		if len(resolved) > 1 {
+			resolved = resolved[1:]
+		}
+		return next, nil
+	}
+
+	m, err := NewResolvedMarathon(resolve, "http", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:1", m.Location())
+
+	_, err = m.Leader()
+	assert.NotNil(t, err)
+	assert.Equal(t, strings.TrimPrefix(up.URL, "http://"), m.Location())
+
+	leader, err := m.Leader()
+	assert.Nil(t, err)
+	assert.Equal(t, "up.example.com:8080", leader)
+}
+
+func TestParseLeader(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewMarathon("localhost:8080", "http", nil)
+	leader, err := m.ParseLeader([]byte(`{"leader": "marathon-leader.example.com:8080"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "marathon-leader.example.com:8080", leader)
+
+	_, err = m.ParseLeader([]byte(`{}`))
+	assert.Equal(t, ErrNoLeader, err)
+}
+
 func TestParseVersion(t *testing.T) {
 	t.Parallel()
 
@@ -167,3 +260,82 @@ func TestParseTasks(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, len(tasks), 2)
 }
+
+func TestParseAppVersions(t *testing.T) {
+	t.Parallel()
+
+	versionsBlob := []byte(`{"versions": ["2015-06-24T14:56:57.466Z", "2015-06-20T10:02:11.091Z"]}`)
+
+	m, _ := NewMarathon("localhost:8080", "http", nil)
+	versions, err := m.ParseAppVersions(versionsBlob)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2015-06-24T14:56:57.466Z", "2015-06-20T10:02:11.091Z"}, versions)
+}
+
+func TestParseAppsWithTasks(t *testing.T) {
+	t.Parallel()
+
+	appsBlob := []byte(`{
+    "apps": [
+        {
+            "id": "/test",
+            "instances": 1,
+            "tasks": [
+                {
+                    "appId": "/test",
+                    "host": "192.168.2.114",
+                    "id": "test.47de43bd-1a81-11e5-bdb6-e6cb6734eaf8",
+                    "ports": [31315]
+                }
+            ]
+        },
+        {
+            "id": "/idle",
+            "instances": 0,
+            "tasks": []
+        }
+    ]
+}
+`)
+
+	m, _ := NewMarathon("localhost:8080", "http", nil)
+	apps, appTasks, err := m.ParseAppsWithTasks(appsBlob)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(apps))
+	assert.Equal(t, 1, len(appTasks["/test"]))
+	assert.Equal(t, "test.47de43bd-1a81-11e5-bdb6-e6cb6734eaf8", appTasks["/test"][0].ID)
+	assert.Equal(t, 0, len(appTasks["/idle"]))
+	_, embedded := appTasks["/idle"]
+	assert.True(t, embedded)
+}
+
+func TestParseAppsWithoutTasks(t *testing.T) {
+	t.Parallel()
+
+	// what a Marathon that ignores embed sends
+	appsBlob := []byte(`{"apps": [{"id": "/test", "instances": 1}]}`)
+
+	m, _ := NewMarathon("localhost:8080", "http", nil)
+	apps, appTasks, err := m.ParseAppsWithTasks(appsBlob)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(apps))
+	_, embedded := appTasks["/test"]
+	assert.False(t, embedded)
+}
+
+func TestPodStatusNotFound(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/pods/my-app::status", r.URL.Path)
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	m, _ := NewMarathon(strings.TrimPrefix(server.URL, "http://"), "http", nil)
+
+	_, err := m.PodStatus("/my-app")
+	assert.Equal(t, ErrNotFound, err)
+	// a 404 is an answer, not a reason to fail over
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://"), m.Location())
+}
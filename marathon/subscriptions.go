@@ -0,0 +1,108 @@
+package marathon
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Subscriptions lists the callback URLs registered for Marathon's HTTP event
+// callbacks
+func (m Marathon) Subscriptions() ([]string, error) {
+	log.WithField("location", m.Location()).Debug("asking Marathon for event subscriptions")
+
+	body, err := m.get("/v2/eventSubscriptions")
+	if err != nil {
+		return nil, err
+	}
+
+	callbacks, err := m.ParseSubscriptions(body)
+	if err != nil {
+		log.WithError(err).Error("could not parse event subscriptions")
+	}
+
+	return callbacks, err
+}
+
+type SubscriptionsResponse struct {
+	CallbackUrls []string `json:"callbackUrls"`
+}
+
+func (m Marathon) ParseSubscriptions(jsonBlob []byte) ([]string, error) {
+	subscriptions := &SubscriptionsResponse{}
+	err := json.Unmarshal(jsonBlob, subscriptions)
+
+	return subscriptions.CallbackUrls, err
+}
+
+// Subscribe registers callbackUrl to receive Marathon's HTTP event callbacks
+func (m Marathon) Subscribe(callbackUrl string) error {
+	_, err := m.do("POST", "/v2/eventSubscriptions", url.Values{"callbackUrl": {callbackUrl}})
+	return err
+}
+
+// Unsubscribe removes callbackUrl from Marathon's HTTP event callbacks
+func (m Marathon) Unsubscribe(callbackUrl string) error {
+	_, err := m.do("DELETE", "/v2/eventSubscriptions", url.Values{"callbackUrl": {callbackUrl}})
+	return err
+}
+
+// EnsureSubscribed registers callbackUrl unless it is registered already
+func (m Marathon) EnsureSubscribed(callbackUrl string) error {
+	callbacks, err := m.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, callback := range callbacks {
+		if callback == callbackUrl {
+			return nil
+		}
+	}
+
+	log.WithField("callbackUrl", redactCallback(callbackUrl)).Info("registering event subscription")
+	return m.Subscribe(callbackUrl)
+}
+
+// KeepSubscribed checks every interval that callbackUrl is still registered
+// (Marathon drops subscriptions, e.g. when its state is reset) until ctx is
+// cancelled
+func (m Marathon) KeepSubscribed(ctx context.Context, callbackUrl string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := m.EnsureSubscribed(callbackUrl)
+		if err != nil {
+			log.WithError(err).Error("could not verify event subscription")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// redactCallback hides credentials and secrets in a callback URL for logging
+func redactCallback(callbackUrl string) string {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil {
+		return "<unparseable callback URL>"
+	}
+
+	if parsed.User != nil {
+		parsed.User = url.User("xxx")
+	}
+	query := parsed.Query()
+	if query.Get("secret") != "" {
+		query.Set("secret", "xxx")
+		parsed.RawQuery = query.Encode()
+	}
+
+	return parsed.String()
+}
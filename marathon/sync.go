@@ -1,45 +1,322 @@
 package marathon
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/CiscoCloud/marathon-consul/consul"
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/CiscoCloud/marathon-consul/tasks"
 	log "github.com/Sirupsen/logrus"
+	version "github.com/hashicorp/go-version"
 )
 
 type MarathonSync struct {
 	marathon Marathoner
-	consul   consul.Consul
+	consul   consul.Store
+	// AppVersions is how many of each app's latest definitions to keep under
+	// <app>/versions, or 0 to keep none
+	AppVersions int
+
+	lock   sync.Mutex
+	status SyncStatus
 }
 
-func NewMarathonSync(marathon Marathoner, consul consul.Consul) *MarathonSync {
-	return &MarathonSync{marathon, consul}
+func NewMarathonSync(marathon Marathoner, consul consul.Store) *MarathonSync {
+	return &MarathonSync{marathon: marathon, consul: consul}
 }
 
-func (m *MarathonSync) Sync() error {
-	// apps
-	log.Info("syncing apps")
-	apps, err := m.marathon.Apps()
+// Failure is a single step of a sync that went wrong
+type Failure struct {
+	Operation string `json:"operation"`
+	// ID is the app or pod the operation was for, if any
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// SyncError lists every step of a sync that went wrong. A sync carries on
+// past failed steps, so everything not listed was synced.
+type SyncError struct {
+	Failures []Failure
+}
+
+func (e *SyncError) Error() string {
+	messages := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		if failure.ID != "" {
+			messages[i] = fmt.Sprintf("%s %s: %s", failure.Operation, failure.ID, failure.Error)
+		} else {
+			messages[i] = fmt.Sprintf("%s: %s", failure.Operation, failure.Error)
+		}
+	}
+	return fmt.Sprintf("sync failed %d times: %s", len(e.Failures), strings.Join(messages, "; "))
+}
+
+// SyncStatus describes the latest sync
+type SyncStatus struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Failures []Failure `json:"failures"`
+}
+
+// Status reports the latest sync, for /status
+func (m *MarathonSync) Status() interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := m.status
+	status.Failures = append([]Failure{}, m.status.Failures...)
+	return status
+}
+
+// fail records a failed step and logs it
+func (m *MarathonSync) fail(operation, id string, err error) {
+	logger := log.WithError(err).WithField("operation", operation)
+	if id != "" {
+		logger = logger.WithField("id", id)
+	}
+	logger.Error("sync step failed")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status.Failures = append(m.status.Failures, Failure{operation, id, err.Error()})
+}
+
+// Sync copies every app (and its history, if asked to), task, pod, pod
+// instance, deployment in progress and group from Marathon to Consul.
+// A failure to sync one app or pod doesn't stop the others: the returned
+// SyncError lists everything that failed. It stops between apps when ctx is
+// cancelled.
+func (m *MarathonSync) Sync(ctx context.Context) error {
+	m.lock.Lock()
+	m.status = SyncStatus{Running: true, Started: time.Now(), Failures: []Failure{}}
+	m.lock.Unlock()
+
+	err := m.sync(ctx)
+
+	m.lock.Lock()
+	m.status.Running = false
+	m.status.Finished = time.Now()
+	failures := append([]Failure{}, m.status.Failures...)
+	m.lock.Unlock()
+
 	if err != nil {
 		return err
 	}
+	if len(failures) > 0 {
+		log.WithField("failures", len(failures)).Error("synced with failures")
+		return &SyncError{failures}
+	}
+	log.Info("synced!")
+	return nil
+}
+
+// sync does the work of Sync, recording failed steps as it goes. It only
+// returns an error when it can't go on at all.
+func (m *MarathonSync) sync(ctx context.Context) error {
+	// apps, and their tasks if Marathon can give us all of them at once
+	log.Info("syncing apps")
+	bulk := m.bulkTasks()
+
+	var apps []*apps.App
+	var appTasks map[string][]*tasks.Task
+	var err error
+	if bulk {
+		apps, appTasks, err = m.marathon.AppsWithTasks()
+	} else {
+		apps, err = m.marathon.Apps()
+	}
+	if err != nil {
+		// without the list of apps there's nothing to compare against
+		m.fail("fetch apps", "", err)
+		return nil
+	}
 	err = m.consul.SyncApps(apps)
 	if err != nil {
-		return err
+		m.fail("sync apps", "", err)
 	}
 
 	// tasks
 	log.Info("syncing tasks")
 	for _, app := range apps {
+		if ctx.Err() != nil {
+			log.Warn("sync interrupted")
+			return ctx.Err()
+		}
+
+		logLabelErrors(app)
+
 		log.WithField("app", app.ID).Debug("syncing tasks for app")
-		tasks, err := m.marathon.Tasks(app.ID)
-		if err != nil {
-			return err
+		// without embedded tasks, an empty list would remove every task
+		tasks, embedded := appTasks[app.ID]
+		if !embedded {
+			tasks, err = m.marathon.Tasks(app.ID)
+			if err != nil {
+				m.fail("fetch tasks", app.ID, err)
+				continue
+			}
+		}
+		ports := app.HostPorts()
+		for _, task := range tasks {
+			task.PortDefinitions = ports
 		}
 		err = m.consul.SyncTasks(app.ID, tasks)
 		if err != nil {
-			return err
+			m.fail("sync tasks", app.ID, err)
+		}
+
+		if m.AppVersions > 0 {
+			m.syncAppVersions(app)
+		} else {
+			// drop what a higher AppVersions kept before
+			m.trimAppVersions(app)
 		}
 	}
-	log.Info("synced!")
+
+	// pods
+	err = m.syncPods(ctx)
+	if err != nil {
+		return err
+	}
+
+	// deployments, in case we missed one finishing
+	log.Info("syncing deployments")
+	deploymentList, err := m.marathon.Deployments()
+	if err != nil {
+		m.fail("fetch deployments", "", err)
+	} else if err = m.consul.SyncDeployments(deploymentList); err != nil {
+		m.fail("sync deployments", "", err)
+	}
+
+	// groups
+	log.Info("syncing groups")
+	groupList, err := m.marathon.Groups()
+	if err != nil {
+		m.fail("fetch groups", "", err)
+	} else if err = m.consul.SyncGroups(groupList); err != nil {
+		m.fail("sync groups", "", err)
+	}
 
 	return nil
 }
+
+// syncAppVersions keeps the app's latest AppVersions definitions. The current
+// definition comes with the app, only earlier ones are fetched. If they can't
+// be, the stored ones are still trimmed to AppVersions.
+func (m *MarathonSync) syncAppVersions(app *apps.App) {
+	log.WithField("app", app.ID).Debug("syncing versions for app")
+	versions, err := m.marathon.AppVersions(app.ID)
+	if err != nil {
+		m.fail("fetch app versions", app.ID, err)
+		m.trimAppVersions(app)
+		return
+	}
+
+	// versions are timestamps, so the latest sort last
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	if len(versions) > m.AppVersions {
+		versions = versions[:m.AppVersions]
+	}
+
+	definitions := make([]*apps.App, 0, len(versions))
+	for _, v := range versions {
+		if v == app.Version {
+			definitions = append(definitions, app)
+			continue
+		}
+
+		definition, err := m.marathon.AppVersion(app.ID, v)
+		if err != nil {
+			m.fail("fetch app version", app.ID, err)
+			m.trimAppVersions(app)
+			return
+		}
+		definitions = append(definitions, definition)
+	}
+
+	err = m.consul.SyncAppVersions(app.ID, definitions)
+	if err != nil {
+		m.fail("sync app versions", app.ID, err)
+	}
+}
+
+// trimAppVersions deletes the app's stored definitions beyond AppVersions
+func (m *MarathonSync) trimAppVersions(app *apps.App) {
+	err := m.consul.TrimAppVersions(app.ID, m.AppVersions)
+	if err != nil {
+		m.fail("trim app versions", app.ID, err)
+	}
+}
+
+// logLabelErrors warns about consul.* labels on app that don't make sense
+func logLabelErrors(app *apps.App) {
+	_, problems := app.Service()
+	for _, problem := range problems {
+		log.WithField("app", app.ID).WithError(problem).Warn("ignoring bad label")
+	}
+}
+
+// syncPods copies every pod and its instances. Marathon only has pods since
+// 1.4, so a missing pods endpoint is not a failure.
+func (m *MarathonSync) syncPods(ctx context.Context) error {
+	log.Info("syncing pods")
+	statuses, err := m.marathon.PodStatuses()
+	if err == ErrNotFound {
+		log.Info("Marathon does not support pods, skipping them")
+		return nil
+	}
+	if err != nil {
+		m.fail("fetch pods", "", err)
+		return nil
+	}
+
+	specs := make([]*pods.Pod, 0, len(statuses))
+	for _, status := range statuses {
+		if status.Spec != nil {
+			specs = append(specs, status.Spec)
+		}
+	}
+	err = m.consul.SyncPods(specs)
+	if err != nil {
+		m.fail("sync pods", "", err)
+	}
+
+	for _, status := range statuses {
+		if ctx.Err() != nil {
+			log.Warn("sync interrupted")
+			return ctx.Err()
+		}
+
+		log.WithField("pod", status.ID).Debug("syncing instances for pod")
+		err = m.consul.SyncPodInstances(status.ID, status.Instances)
+		if err != nil {
+			m.fail("sync pod instances", status.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// bulkTasks tells whether Marathon can embed every app's tasks in /v2/apps,
+// saving a request per app. If its version can't be told, it is assumed to be
+// recent.
+func (m *MarathonSync) bulkTasks() bool {
+	v, err := m.marathon.Version()
+	if err != nil {
+		log.WithError(err).Warn("version parsing failed, fetching tasks app by app")
+		return false
+	}
+
+	constraint, _ := version.NewConstraint(BulkTasksVersion)
+	if !constraint.Check(v) {
+		log.WithField("version", v).Info("old Marathon version -- fetching tasks app by app")
+		return false
+	}
+	return true
+}
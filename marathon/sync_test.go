@@ -0,0 +1,216 @@
+package marathon
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/consul"
+	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingMarathoner counts per-app task requests, failing those for apps in
+// missing
+type countingMarathoner struct {
+	mocks.Marathoner
+	taskRequests int
+	missing      map[string]bool
+}
+
+func (m *countingMarathoner) Tasks(app string) ([]*tasks.Task, error) {
+	m.taskRequests++
+	if m.missing[app] {
+		return nil, ErrNotFound
+	}
+	return m.Marathoner.Tasks(app)
+}
+
+func TestSyncTasksInBulk(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		version      string
+		taskRequests int
+	}{
+		{"1.4.0", 0},
+		{"0.7.6", 2},
+		// no telling, so no assuming
+		{"unknown", 2},
+	} {
+		remote := &countingMarathoner{Marathoner: mocks.Marathoner{
+			MarathonVersion: test.version,
+			AppList:         []*apps.App{{ID: "/one"}, {ID: "/two"}},
+			TaskList: map[string][]*tasks.Task{
+				"/one": {{ID: "one.1", AppID: "/one"}},
+				"/two": {{ID: "two.1", AppID: "/two"}},
+			},
+		}}
+		kv := mocks.NewKVer()
+		store := consul.NewConsul(kv, "marathon")
+
+		err := NewMarathonSync(remote, &store).Sync(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, test.taskRequests, remote.taskRequests, test.version)
+
+		for _, key := range []string{"marathon/one/tasks/one.1", "marathon/two/tasks/two.1"} {
+			result, _, err := kv.Get(key)
+			assert.Nil(t, err)
+			assert.NotNil(t, result, key)
+		}
+	}
+}
+
+// unembeddedMarathoner ignores embed=apps.tasks, like some Marathons do
+type unembeddedMarathoner struct {
+	countingMarathoner
+}
+
+func (m *unembeddedMarathoner) AppsWithTasks() ([]*apps.App, map[string][]*tasks.Task, error) {
+	return m.AppList, map[string][]*tasks.Task{}, nil
+}
+
+func TestSyncTasksNotEmbedded(t *testing.T) {
+	t.Parallel()
+
+	remote := &unembeddedMarathoner{countingMarathoner{Marathoner: mocks.Marathoner{
+		AppList:  []*apps.App{{ID: "/one"}},
+		TaskList: map[string][]*tasks.Task{"/one": {{ID: "one.1", AppID: "/one"}}},
+	}}}
+	kv := mocks.NewKVer()
+	store := consul.NewConsul(kv, "marathon")
+	assert.Nil(t, store.UpdateTask(&tasks.Task{ID: "one.1", AppID: "/one"}))
+
+	// test!
+	err := NewMarathonSync(remote, &store).Sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, remote.taskRequests)
+
+	// the task is still there
+	result, _, err := kv.Get("marathon/one/tasks/one.1")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+}
+
+func TestSyncContinuesOnError(t *testing.T) {
+	t.Parallel()
+
+	remote := &countingMarathoner{
+		Marathoner: mocks.Marathoner{
+			MarathonVersion: "0.7.6",
+			AppList:         []*apps.App{{ID: "/gone"}, {ID: "/two"}},
+			TaskList: map[string][]*tasks.Task{
+				"/two": {{ID: "two.1", AppID: "/two"}},
+			},
+		},
+		missing: map[string]bool{"/gone": true},
+	}
+	kv := mocks.NewKVer()
+	store := consul.NewConsul(kv, "marathon")
+	sync := NewMarathonSync(remote, &store)
+
+	err := sync.Sync(context.Background())
+	assert.NotNil(t, err)
+	syncErr, ok := err.(*SyncError)
+	assert.True(t, ok)
+	assert.Equal(t, []Failure{{"fetch tasks", "/gone", ErrNotFound.Error()}}, syncErr.Failures)
+
+	// the app after the failed one is synced anyway
+	result, _, err := kv.Get("marathon/two/tasks/two.1")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+
+	status := sync.Status().(SyncStatus)
+	assert.False(t, status.Running)
+	assert.Equal(t, syncErr.Failures, status.Failures)
+}
+
+func TestSyncAppVersions(t *testing.T) {
+	t.Parallel()
+
+	app := &apps.App{ID: "/one", Version: "2015-03-03T00:00:00.000Z"}
+	remote := mocks.Marathoner{
+		AppList: []*apps.App{app},
+		AppVersionList: map[string][]*apps.App{"/one": {
+			{ID: "/one", Version: "2015-01-01T00:00:00.000Z"},
+			{ID: "/one", Version: "2015-02-02T00:00:00.000Z", Instances: 2},
+			app,
+		}},
+	}
+	kv := mocks.NewKVer()
+	store := consul.NewConsul(kv, "marathon")
+	sync := NewMarathonSync(remote, &store)
+	sync.AppVersions = 2
+
+	err := sync.Sync(context.Background())
+	assert.Nil(t, err)
+
+	// only the latest two are kept
+	history, _, err := kv.List("marathon/one/versions/")
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+
+	result, _, err := kv.Get("marathon/one/versions/2015-02-02T00:00:00.000Z")
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		definition := &apps.App{}
+		assert.Nil(t, json.Unmarshal(result.Value, definition))
+		assert.Equal(t, 2, definition.Instances)
+	}
+
+	// and the history outlives syncing apps
+	err = store.SyncApps([]*apps.App{app})
+	assert.Nil(t, err)
+
+	history, _, err = kv.List("marathon/one/versions/")
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+}
+
+// lostVersionMarathoner lists a version of every app it can't fetch
+type lostVersionMarathoner struct {
+	mocks.Marathoner
+}
+
+func (m lostVersionMarathoner) AppVersions(app string) ([]string, error) {
+	versions, err := m.Marathoner.AppVersions(app)
+	return append(versions, "2015-02-02T00:00:00.000Z"), err
+}
+
+func TestSyncAppVersionsLowered(t *testing.T) {
+	t.Parallel()
+
+	app := &apps.App{ID: "/one", Version: "2015-03-03T00:00:00.000Z"}
+	kv := mocks.NewKVer()
+	store := consul.NewConsul(kv, "marathon")
+	assert.Nil(t, store.SyncAppVersions(app.ID, []*apps.App{
+		{ID: "/one", Version: "2015-01-01T00:00:00.000Z"},
+		{ID: "/one", Version: "2015-02-02T00:00:00.000Z"},
+		app,
+	}))
+
+	// an earlier version can't be fetched, but the history still shrinks
+	sync := NewMarathonSync(lostVersionMarathoner{mocks.Marathoner{
+		AppList:        []*apps.App{app},
+		AppVersionList: map[string][]*apps.App{"/one": {app}},
+	}}, &store)
+	sync.AppVersions = 2
+	assert.NotNil(t, sync.Sync(context.Background()))
+
+	history, _, err := kv.List("marathon/one/versions/")
+	assert.Nil(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, "marathon/one/versions/2015-02-02T00:00:00.000Z", history[0].Key)
+		assert.Equal(t, "marathon/one/versions/2015-03-03T00:00:00.000Z", history[1].Key)
+	}
+
+	// and without app-versions, it goes away
+	sync.AppVersions = 0
+	assert.Nil(t, sync.Sync(context.Background()))
+
+	history, _, err = kv.List("marathon/one/versions/")
+	assert.Nil(t, err)
+	assert.Empty(t, history)
+}
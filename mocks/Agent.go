@@ -0,0 +1,68 @@
+package mocks
+
+import (
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Agent keeps registered services in memory
+type Agent struct {
+	services map[string]*api.AgentService
+	lock     *sync.RWMutex
+}
+
+func NewAgent() Agent {
+	return Agent{
+		make(map[string]*api.AgentService),
+		&sync.RWMutex{},
+	}
+}
+
+func (a Agent) Services() (map[string]*api.AgentService, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	services := make(map[string]*api.AgentService, len(a.services))
+	for id, service := range a.services {
+		services[id] = service
+	}
+	return services, nil
+}
+
+func (a Agent) ServiceRegister(registration *api.AgentServiceRegistration) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.services[registration.ID] = &api.AgentService{
+		ID:      registration.ID,
+		Service: registration.Name,
+		Tags:    registration.Tags,
+		Port:    registration.Port,
+		Address: registration.Address,
+		Meta:    registration.Meta,
+	}
+
+	// like Consul, register a sidecar proxy on the side
+	if registration.Connect != nil && registration.Connect.SidecarService != nil {
+		id := registration.ID + "-sidecar-proxy"
+		a.services[id] = &api.AgentService{
+			Kind:    api.ServiceKindConnectProxy,
+			ID:      id,
+			Service: registration.Name + "-sidecar-proxy",
+			Address: registration.Address,
+			Proxy:   registration.Connect.SidecarService.Proxy,
+		}
+	}
+	return nil
+}
+
+func (a Agent) ServiceDeregister(id string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// like Consul, deregister the service's sidecar proxy with it
+	delete(a.services, id)
+	delete(a.services, id+"-sidecar-proxy")
+	return nil
+}
@@ -0,0 +1,100 @@
+package mocks
+
+import (
+	"errors"
+
+	"github.com/CiscoCloud/marathon-consul/apps"
+	"github.com/CiscoCloud/marathon-consul/deployments"
+	"github.com/CiscoCloud/marathon-consul/groups"
+	"github.com/CiscoCloud/marathon-consul/pods"
+	"github.com/CiscoCloud/marathon-consul/tasks"
+	version "github.com/hashicorp/go-version"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Marathoner serves fixed apps, app versions, tasks, pods, deployments and groups
+type Marathoner struct {
+	// MarathonVersion defaults to 1.4.0
+	MarathonVersion string
+	AppList         []*apps.App
+	TaskList        map[string][]*tasks.Task
+	// AppVersionList holds the earlier definitions of each app, by app ID
+	AppVersionList map[string][]*apps.App
+	PodList        []*pods.Status
+	DeploymentList []*deployments.Deployment
+	GroupList      []*groups.Group
+	// NotFound is returned for unknown pods and app versions, so it can be
+	// set to the error the caller expects
+	NotFound error
+}
+
+func (m Marathoner) Version() (*version.Version, error) {
+	if m.MarathonVersion == "" {
+		return version.NewVersion("1.4.0")
+	}
+	return version.NewVersion(m.MarathonVersion)
+}
+
+// AppsWithTasks embeds tasks in every app, like Marathon does
+func (m Marathoner) AppsWithTasks() ([]*apps.App, map[string][]*tasks.Task, error) {
+	appTasks := make(map[string][]*tasks.Task, len(m.AppList))
+	for _, app := range m.AppList {
+		appTasks[app.ID] = append([]*tasks.Task{}, m.TaskList[app.ID]...)
+	}
+	return m.AppList, appTasks, nil
+}
+
+func (m Marathoner) Apps() ([]*apps.App, error) {
+	return m.AppList, nil
+}
+
+func (m Marathoner) AppVersions(app string) ([]string, error) {
+	versions := []string{}
+	for _, definition := range m.AppVersionList[app] {
+		versions = append(versions, definition.Version)
+	}
+	return versions, nil
+}
+
+func (m Marathoner) AppVersion(app, version string) (*apps.App, error) {
+	for _, definition := range m.AppVersionList[app] {
+		if definition.Version == version {
+			return definition, nil
+		}
+	}
+
+	if m.NotFound != nil {
+		return nil, m.NotFound
+	}
+	return nil, ErrNotFound
+}
+
+func (m Marathoner) Tasks(app string) ([]*tasks.Task, error) {
+	return m.TaskList[app], nil
+}
+
+func (m Marathoner) PodStatuses() ([]*pods.Status, error) {
+	return m.PodList, nil
+}
+
+func (m Marathoner) PodStatus(pod string) (*pods.Status, error) {
+	for _, status := range m.PodList {
+		if status.ID == pod {
+			return status, nil
+		}
+	}
+
+	if m.NotFound != nil {
+		return nil, m.NotFound
+	}
+	return nil, ErrNotFound
+}
+
+func (m Marathoner) Deployments() ([]*deployments.Deployment, error) {
+	return m.DeploymentList, nil
+}
+
+func (m Marathoner) Groups() ([]*groups.Group, error) {
+	return m.GroupList, nil
+}
@@ -0,0 +1,87 @@
+package pods
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+type InstanceEndpoint struct {
+	Name              string `json:"name"`
+	AllocatedHostPort int    `json:"allocatedHostPort"`
+	Healthy           bool   `json:"healthy"`
+}
+
+type InstanceContainer struct {
+	Name        string             `json:"name"`
+	ContainerID string             `json:"containerId"`
+	Status      string             `json:"status"`
+	Endpoints   []InstanceEndpoint `json:"endpoints"`
+}
+
+type InstanceNetwork struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+// Instance is a running instance of a pod, as reported by /v2/pods/<id>::status
+type Instance struct {
+	ID            string              `json:"id"`
+	PodID         string              `json:"podId"`
+	Status        string              `json:"status"`
+	StatusSince   string              `json:"statusSince"`
+	AgentHostname string              `json:"agentHostname"`
+	AgentID       string              `json:"agentId"`
+	Containers    []InstanceContainer `json:"containers"`
+	Networks      []InstanceNetwork   `json:"networks"`
+	LastUpdated   string              `json:"lastUpdated"`
+}
+
+func (instance *Instance) Key() string {
+	pod := &Pod{ID: instance.PodID}
+	return fmt.Sprintf("%s/%s", pod.InstancesKey(), instance.ID)
+}
+
+func (instance *Instance) KV() *api.KVPair {
+	serialized, _ := json.Marshal(instance)
+
+	return &api.KVPair{
+		Key:   instance.Key(),
+		Value: serialized,
+	}
+}
+
+// Status is a pod definition together with its instances, as returned by
+// /v2/pods/::status
+type Status struct {
+	ID        string      `json:"id"`
+	Spec      *Pod        `json:"spec"`
+	Status    string      `json:"status"`
+	Instances []*Instance `json:"instances"`
+}
+
+// ParseStatus parses a single pod status, filling in the pod ID of every
+// instance
+func ParseStatus(jsonBlob []byte) (*Status, error) {
+	status := &Status{}
+	err := json.Unmarshal(jsonBlob, status)
+	status.fillPodIDs()
+	return status, err
+}
+
+// ParseStatuses parses a list of pod statuses, filling in the pod ID of every
+// instance
+func ParseStatuses(jsonBlob []byte) ([]*Status, error) {
+	statuses := []*Status{}
+	err := json.Unmarshal(jsonBlob, &statuses)
+	for _, status := range statuses {
+		status.fillPodIDs()
+	}
+	return statuses, err
+}
+
+func (status *Status) fillPodIDs() {
+	for _, instance := range status.Instances {
+		instance.PodID = status.ID
+	}
+}
@@ -0,0 +1,75 @@
+package pods
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/CiscoCloud/marathon-consul/utils"
+	"github.com/hashicorp/consul/api"
+)
+
+// KeyPrefix is the subtree pods live in, so they can't collide with apps
+const KeyPrefix = "_pods"
+
+type Endpoint struct {
+	Name          string            `json:"name"`
+	ContainerPort int               `json:"containerPort"`
+	HostPort      int               `json:"hostPort"`
+	Protocol      []string          `json:"protocol"`
+	Labels        map[string]string `json:"labels"`
+}
+
+type Image struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+type Resources struct {
+	CPUs float64 `json:"cpus"`
+	Mem  float64 `json:"mem"`
+	Disk float64 `json:"disk"`
+}
+
+type Container struct {
+	Name      string            `json:"name"`
+	Image     *Image            `json:"image"`
+	Resources Resources         `json:"resources"`
+	Endpoints []Endpoint        `json:"endpoints"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type Network struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+}
+
+type Scaling struct {
+	Kind      string `json:"kind"`
+	Instances int    `json:"instances"`
+}
+
+type Pod struct {
+	ID         string            `json:"id"`
+	Labels     map[string]string `json:"labels"`
+	Version    string            `json:"version"`
+	Scaling    *Scaling          `json:"scaling"`
+	Containers []Container       `json:"containers"`
+	Networks   []Network         `json:"networks"`
+}
+
+func (pod *Pod) KV() *api.KVPair {
+	serialized, _ := json.Marshal(pod)
+
+	return &api.KVPair{
+		Key:   pod.Key(),
+		Value: serialized,
+	}
+}
+
+func (pod *Pod) Key() string {
+	return fmt.Sprintf("%s/%s", KeyPrefix, utils.CleanID(pod.ID))
+}
+
+// InstancesKey is the subtree the pod's instances live in
+func (pod *Pod) InstancesKey() string {
+	return fmt.Sprintf("%s/instances", pod.Key())
+}
@@ -0,0 +1,74 @@
+package pods
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testStatus = []byte(`[{
+	"id": "/web/frontend",
+	"spec": {
+		"id": "/web/frontend",
+		"version": "2017-03-01T10:00:00.000Z",
+		"scaling": {"kind": "fixed", "instances": 1},
+		"containers": [{
+			"name": "nginx",
+			"image": {"kind": "DOCKER", "id": "nginx"},
+			"resources": {"cpus": 0.1, "mem": 32},
+			"endpoints": [{"name": "http", "containerPort": 80, "hostPort": 0, "protocol": ["tcp"]}]
+		}],
+		"networks": [{"mode": "host"}]
+	},
+	"status": "STABLE",
+	"instances": [{
+		"id": "web_frontend.instance-6a8ff5bf-fe5b-11e6-a8b5-a2e1a1a07a3b",
+		"status": "STABLE",
+		"agentHostname": "10.0.1.2",
+		"containers": [{
+			"name": "nginx",
+			"containerId": "web_frontend.instance-6a8ff5bf-fe5b-11e6-a8b5-a2e1a1a07a3b.nginx",
+			"status": "TASK_RUNNING",
+			"endpoints": [{"name": "http", "allocatedHostPort": 31045, "healthy": true}]
+		}],
+		"networks": [{"name": "dcos", "addresses": ["9.0.0.2"]}]
+	}]
+}]`)
+
+func TestParseStatuses(t *testing.T) {
+	t.Parallel()
+
+	statuses, err := ParseStatuses(testStatus)
+	assert.Nil(t, err)
+	assert.Len(t, statuses, 1)
+
+	status := statuses[0]
+	assert.Equal(t, "/web/frontend", status.Spec.ID)
+	assert.Equal(t, "http", status.Spec.Containers[0].Endpoints[0].Name)
+	assert.Len(t, status.Instances, 1)
+
+	instance := status.Instances[0]
+	assert.Equal(t, "/web/frontend", instance.PodID)
+	assert.Equal(t, "10.0.1.2", instance.AgentHostname)
+	assert.Equal(t, InstanceEndpoint{"http", 31045, true}, instance.Containers[0].Endpoints[0])
+}
+
+func TestPodKey(t *testing.T) {
+	t.Parallel()
+
+	pod := &Pod{ID: "/web/frontend"}
+	assert.Equal(t, "_pods/web-frontend", pod.Key())
+	assert.Equal(t, "_pods/web-frontend/instances", pod.InstancesKey())
+}
+
+func TestInstanceKV(t *testing.T) {
+	t.Parallel()
+
+	instance := &Instance{ID: "web_frontend.instance-1", PodID: "/web/frontend"}
+	kv := instance.KV()
+	assert.Equal(t, "_pods/web-frontend/instances/web_frontend.instance-1", kv.Key)
+
+	parsed := &Instance{}
+	assert.Nil(t, json.Unmarshal(kv.Value, parsed))
+	assert.Equal(t, instance, parsed)
+}
@@ -0,0 +1,152 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Mesos task states
+const (
+	Staging        = "TASK_STAGING"
+	Starting       = "TASK_STARTING"
+	Running        = "TASK_RUNNING"
+	Killing        = "TASK_KILLING"
+	Finished       = "TASK_FINISHED"
+	Failed         = "TASK_FAILED"
+	Killed         = "TASK_KILLED"
+	Error          = "TASK_ERROR"
+	Lost           = "TASK_LOST"
+	Dropped        = "TASK_DROPPED"
+	Gone           = "TASK_GONE"
+	GoneByOperator = "TASK_GONE_BY_OPERATOR"
+	Unreachable    = "TASK_UNREACHABLE"
+	Unknown        = "TASK_UNKNOWN"
+)
+
+const timestampLayout = time.RFC3339
+
+var ErrUnknownState = errors.New("unknown task status")
+
+// Action is what happens to a task in Consul when it reaches a state
+type Action string
+
+const (
+	// Keep stores the task as it is
+	Keep Action = "keep"
+	// Mark stores the task with a MarkedAt timestamp, so consumers can stop
+	// sending it traffic, and removes it once it has been marked for the
+	// grace period
+	Mark Action = "mark"
+	// Remove deletes the task
+	Remove Action = "remove"
+)
+
+// Policy decides what happens to a task in each state
+type Policy struct {
+	Actions map[string]Action
+	// Grace is how long a task stays marked before it is removed
+	Grace time.Duration
+}
+
+// DefaultPolicy keeps live tasks, marks tasks that may yet come back or are
+// on their way out, and removes tasks that are gone for good
+func DefaultPolicy() Policy {
+	return Policy{
+		Actions: map[string]Action{
+			Staging:        Keep,
+			Starting:       Keep,
+			Running:        Keep,
+			Killing:        Mark,
+			Unreachable:    Mark,
+			Unknown:        Mark,
+			Finished:       Remove,
+			Failed:         Remove,
+			Killed:         Remove,
+			Error:          Remove,
+			Lost:           Remove,
+			Dropped:        Remove,
+			Gone:           Remove,
+			GoneByOperator: Remove,
+		},
+		Grace: 5 * time.Minute,
+	}
+}
+
+// ParsePolicy overrides the default policy with a comma-separated list of
+// state=action pairs, e.g. "TASK_UNREACHABLE=keep,TASK_KILLING=remove"
+func ParsePolicy(overrides string, grace time.Duration) (Policy, error) {
+	policy := DefaultPolicy()
+	policy.Grace = grace
+
+	for _, override := range strings.Split(overrides, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return policy, fmt.Errorf("%s: expected state=action", override)
+		}
+		state := strings.ToUpper(strings.TrimSpace(parts[0]))
+		action := Action(strings.ToLower(strings.TrimSpace(parts[1])))
+
+		if _, known := policy.Actions[state]; !known {
+			return policy, fmt.Errorf("%s: %s", state, ErrUnknownState)
+		}
+		if action != Keep && action != Mark && action != Remove {
+			return policy, fmt.Errorf("%s: action must be keep, mark or remove", override)
+		}
+		policy.Actions[state] = action
+	}
+
+	return policy, nil
+}
+
+// Action returns what to do with a task in state
+func (p Policy) Action(state string) (Action, error) {
+	action, known := p.Actions[state]
+	if !known {
+		return "", ErrUnknownState
+	}
+	return action, nil
+}
+
+// Mark flags the task as marked as of now, unless Preserve later finds it
+// was marked earlier
+func (task *Task) Mark(now time.Time) {
+	task.MarkedAt = now.UTC().Format(timestampLayout)
+}
+
+// Serving tells whether the task should get traffic: it isn't marked, and is
+// running or was listed by Marathon without a status
+func (task *Task) Serving() bool {
+	return task.MarkedAt == "" && (task.TaskStatus == "" || task.TaskStatus == Running)
+}
+
+// MarkedBefore tells whether the task was marked before cutoff
+func (task *Task) MarkedBefore(cutoff time.Time) bool {
+	return before(task.MarkedAt, cutoff)
+}
+
+// Terminate stamps the task as removed as of now, for its tombstone
+func (task *Task) Terminate(now time.Time) {
+	task.TerminatedAt = now.UTC().Format(timestampLayout)
+}
+
+// TerminatedBefore tells whether the task's tombstone dates from before
+// cutoff
+func (task *Task) TerminatedBefore(cutoff time.Time) bool {
+	return before(task.TerminatedAt, cutoff)
+}
+
+func before(timestamp string, cutoff time.Time) bool {
+	if timestamp == "" {
+		return false
+	}
+
+	parsed, err := time.Parse(timestampLayout, timestamp)
+	return err == nil && parsed.Before(cutoff)
+}
@@ -0,0 +1,65 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := DefaultPolicy()
+	for state, expected := range map[string]Action{
+		Running:        Keep,
+		Killing:        Mark,
+		Unreachable:    Mark,
+		Gone:           Remove,
+		GoneByOperator: Remove,
+		Dropped:        Remove,
+	} {
+		action, err := policy.Action(state)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, action, state)
+	}
+
+	_, err := policy.Action("TASK_BATMAN")
+	assert.Equal(t, ErrUnknownState, err)
+}
+
+func TestParsePolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParsePolicy("task_unreachable=remove, TASK_KILLING=keep", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, policy.Grace)
+	assert.Equal(t, Remove, policy.Actions[Unreachable])
+	assert.Equal(t, Keep, policy.Actions[Killing])
+	assert.Equal(t, Mark, policy.Actions[Unknown])
+
+	_, err = ParsePolicy("TASK_BATMAN=keep", time.Minute)
+	assert.NotNil(t, err)
+	_, err = ParsePolicy("TASK_RUNNING=ignore", time.Minute)
+	assert.NotNil(t, err)
+	_, err = ParsePolicy("TASK_RUNNING", time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestMarkedBefore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	task := &Task{}
+	assert.False(t, task.MarkedBefore(now))
+
+	task.Mark(now.Add(-time.Hour))
+	assert.True(t, task.MarkedBefore(now))
+	assert.False(t, task.MarkedBefore(now.Add(-2*time.Hour)))
+
+	// a task stays marked from the first time
+	update := &Task{}
+	update.Mark(now)
+	update.Preserve(task)
+	assert.Equal(t, task.MarkedAt, update.MarkedAt)
+}
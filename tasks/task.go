@@ -3,19 +3,69 @@ package tasks
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/CiscoCloud/marathon-consul/utils"
 	"github.com/hashicorp/consul/api"
 )
 
+type IPAddress struct {
+	IPAddress string `json:"ipAddress"`
+	Protocol  string `json:"protocol"`
+}
+
+type HealthCheckResult struct {
+	Alive               bool   `json:"alive"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	FirstSuccess        string `json:"firstSuccess"`
+	LastFailure         string `json:"lastFailure"`
+	LastSuccess         string `json:"lastSuccess"`
+	LastFailureCause    string `json:"lastFailureCause,omitempty"`
+	TaskID              string `json:"taskId"`
+}
+
 type Task struct {
-	Timestamp  string `json:"timestamp"`
-	SlaveID    string `json:"slaveId"`
-	ID         string `json:"id"`
-	TaskStatus string `json:"taskStatus"`
-	AppID      string `json:"appId"`
-	Host       string `json:"host"`
-	Ports      []int  `json:"ports"`
-	Version    string `json:"version"`
+	Timestamp    string      `json:"timestamp"`
+	SlaveID      string      `json:"slaveId"`
+	ID           string      `json:"id"`
+	TaskStatus   string      `json:"taskStatus"`
+	AppID        string      `json:"appId"`
+	Host         string      `json:"host"`
+	IPAddresses  []IPAddress `json:"ipAddresses"`
+	Ports        []int       `json:"ports"`
+	ServicePorts []int       `json:"servicePorts"`
+	// PortDefinitions names the ports in Ports, in order. Marathon doesn't
+	// report them per task; they are copied from the app.
+	PortDefinitions []apps.PortDefinition `json:"portDefinitions"`
+	StagedAt        string                `json:"stagedAt"`
+	StartedAt       string                `json:"startedAt"`
+	Version         string                `json:"version"`
+	// HealthCheckResults are only known from /v2/apps/<id>/tasks
+	HealthCheckResults []HealthCheckResult `json:"healthCheckResults"`
+	// MarkedAt is set while the task is in a state the policy marks
+	MarkedAt string `json:"markedAt,omitempty"`
+	// TerminatedAt is set on tombstones, when the task was removed
+	TerminatedAt string `json:"terminatedAt,omitempty"`
+}
+
+type task Task
+
+// UnmarshalJSON decodes a task, taking its status from state when there's no
+// taskStatus: Marathon's task API calls it state, status events taskStatus.
+func (t *Task) UnmarshalJSON(data []byte) error {
+	decoded := struct {
+		*task
+		State string `json:"state"`
+	}{task: (*task)(t)}
+
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	if t.TaskStatus == "" {
+		t.TaskStatus = decoded.State
+	}
+	return nil
 }
 
 func ParseTask(event []byte) (*Task, error) {
@@ -32,6 +82,15 @@ func (task *Task) Key() string {
 	)
 }
 
+// TombstoneKey is where the task is kept for a while after it terminated
+func (task *Task) TombstoneKey() string {
+	return fmt.Sprintf(
+		"%s/terminated/%s",
+		utils.CleanID(task.AppID),
+		task.ID,
+	)
+}
+
 func (task *Task) KV() *api.KVPair {
 	serialized, _ := json.Marshal(task)
 
@@ -40,3 +99,58 @@ func (task *Task) KV() *api.KVPair {
 		Value: serialized,
 	}
 }
+
+// Preserve merges stored, an earlier record of the same task, into task: the
+// status and timestamp are task's, and every other field task leaves empty is
+// kept from stored. Status events carry less than /v2/apps/<id>/tasks does,
+// so this keeps health results, IPs, start times and the like.
+func (task *Task) Preserve(stored *Task) {
+	if task.SlaveID == "" {
+		task.SlaveID = stored.SlaveID
+	}
+	if task.Host == "" {
+		task.Host = stored.Host
+	}
+	if len(task.IPAddresses) == 0 {
+		task.IPAddresses = stored.IPAddresses
+	}
+	if len(task.Ports) == 0 {
+		task.Ports = stored.Ports
+	}
+	if len(task.ServicePorts) == 0 {
+		task.ServicePorts = stored.ServicePorts
+	}
+	if len(task.PortDefinitions) == 0 {
+		task.PortDefinitions = stored.PortDefinitions
+	}
+	if task.StagedAt == "" {
+		task.StagedAt = stored.StagedAt
+	}
+	if task.StartedAt == "" {
+		task.StartedAt = stored.StartedAt
+	}
+	if task.Version == "" {
+		task.Version = stored.Version
+	}
+	if len(task.HealthCheckResults) == 0 {
+		task.HealthCheckResults = stored.HealthCheckResults
+	}
+	// the grace period runs from when the task was first marked
+	if task.MarkedAt != "" && stored.MarkedAt != "" {
+		task.MarkedAt = stored.MarkedAt
+	}
+}
+
+// Resync is Preserve for a task listed by Marathon during a sync, which knows
+// nothing of marks: the stored status is kept if Marathon didn't say, and
+// the stored mark until the task is running again.
+func (task *Task) Resync(stored *Task) {
+	task.Preserve(stored)
+
+	if task.TaskStatus == "" {
+		task.TaskStatus = stored.TaskStatus
+	}
+	if task.MarkedAt == "" && task.TaskStatus != Running {
+		task.MarkedAt = stored.MarkedAt
+	}
+}
@@ -3,8 +3,10 @@ package tasks
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 var testTask = &Task{
@@ -48,3 +50,66 @@ func TestKV(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%s/tasks/%s", "my-app", testTask.ID), kv.Key)
 	assert.Equal(t, jsonified, kv.Value)
 }
+
+func TestPreserve(t *testing.T) {
+	t.Parallel()
+
+	stored := &Task{
+		ID:              "my-app_0-1396592784349",
+		IPAddresses:     []IPAddress{{"10.0.0.2", "IPv4"}},
+		ServicePorts:    []int{10000},
+		PortDefinitions: []apps.PortDefinition{{Port: 0, Protocol: "tcp", Name: "http"}},
+		StagedAt:        "2014-03-01T23:29:29.158Z",
+		StartedAt:       "2014-03-01T23:29:30.158Z",
+	}
+	event := &Task{
+		ID:          stored.ID,
+		TaskStatus:  "TASK_RUNNING",
+		IPAddresses: []IPAddress{{"10.0.0.3", "IPv4"}},
+	}
+
+	event.Preserve(stored)
+	assert.Equal(t, "10.0.0.3", event.IPAddresses[0].IPAddress)
+	assert.Equal(t, stored.ServicePorts, event.ServicePorts)
+	assert.Equal(t, stored.PortDefinitions, event.PortDefinitions)
+	assert.Equal(t, stored.StagedAt, event.StagedAt)
+	assert.Equal(t, stored.StartedAt, event.StartedAt)
+}
+
+func TestTombstoneKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, fmt.Sprintf("my-app/terminated/%s", testTask.ID), testTask.TombstoneKey())
+}
+
+func TestParseTaskState(t *testing.T) {
+	t.Parallel()
+
+	// as listed by /v2/apps/<id>/tasks
+	task, err := ParseTask([]byte(`{"id": "my-app.1", "state": "TASK_UNREACHABLE"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "TASK_UNREACHABLE", task.TaskStatus)
+
+	// as stored, or sent in a status event
+	task, err = ParseTask([]byte(`{"id": "my-app.1", "taskStatus": "TASK_RUNNING"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "TASK_RUNNING", task.TaskStatus)
+}
+
+func TestResync(t *testing.T) {
+	t.Parallel()
+
+	stored := &Task{ID: "my-app.1", TaskStatus: "TASK_UNREACHABLE", StartedAt: "2014-03-01T23:29:30.158Z"}
+	stored.Mark(time.Now())
+
+	listed := &Task{ID: stored.ID}
+	listed.Resync(stored)
+	assert.Equal(t, stored.TaskStatus, listed.TaskStatus)
+	assert.Equal(t, stored.MarkedAt, listed.MarkedAt)
+	assert.Equal(t, stored.StartedAt, listed.StartedAt)
+
+	// back up and running
+	running := &Task{ID: stored.ID, TaskStatus: "TASK_RUNNING"}
+	running.Resync(stored)
+	assert.Equal(t, "", running.MarkedAt)
+}
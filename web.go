@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/CiscoCloud/marathon-consul/consul"
 	"github.com/CiscoCloud/marathon-consul/events"
+	"github.com/CiscoCloud/marathon-consul/marathon"
+	"github.com/CiscoCloud/marathon-consul/pods"
 	"github.com/CiscoCloud/marathon-consul/tasks"
 	log "github.com/Sirupsen/logrus"
 )
@@ -17,8 +20,72 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
+// StatusReporter is implemented by components that report their runtime
+// state on /status
+type StatusReporter interface {
+	Status() interface{}
+}
+
+// StatusHandler serves the state of every registered reporter as JSON, keyed
+// by name
+type StatusHandler map[string]StatusReporter
+
+func (sh StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := make(map[string]interface{}, len(sh))
+	for name, reporter := range sh {
+		status[name] = reporter.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.WithError(err).Error("could not encode status")
+	}
+}
+
 type ForwardHandler struct {
-	consul consul.Consul
+	consul consul.Store
+	// marathon is asked for pod definitions and instances, since pod events
+	// don't carry them
+	marathon marathon.Marathoner
+	// policy decides what status updates do to tasks; the default if nil
+	policy *tasks.Policy
+	// apps remembers the run specs known to be apps, so their instance
+	// events don't cost a pod lookup each
+	apps appIDs
+}
+
+// the most app IDs appIDs remembers before starting over
+const maxAppIDs = 10000
+
+type appIDs struct {
+	lock sync.Mutex
+	ids  map[string]bool
+}
+
+func (a *appIDs) add(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.ids == nil || len(a.ids) >= maxAppIDs {
+		a.ids = map[string]bool{}
+	}
+	a.ids[id] = true
+}
+
+// forget drops id, for when a pod takes the ID of an app that's gone
+func (a *appIDs) forget(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.ids, id)
+}
+
+func (a *appIDs) has(id string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.ids[id]
 }
 
 func (fh *ForwardHandler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -37,15 +104,33 @@ func (fh *ForwardHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch eventType {
-	case "api_post_event", "deployment_info":
+	case "api_post_event":
 		log.WithField("eventType", eventType).Info("handling event")
 		err = fh.HandleAppEvent(body)
+	case "deployment_info":
+		log.WithField("eventType", eventType).Info("handling event")
+		err = fh.HandleAppEvent(body)
+		if err == nil {
+			err = fh.HandleDeploymentEvent(body)
+		}
+	case "deployment_success", "deployment_failed", "deployment_step_success", "deployment_step_failure":
+		log.WithField("eventType", eventType).Info("handling event")
+		err = fh.HandleDeploymentEvent(body)
 	case "app_terminated_event":
 		log.WithField("eventType", "app_terminated_event").Info("handling event")
 		err = fh.HandleTerminationEvent(body)
 	case "status_update_event":
 		log.WithField("eventType", "status_update_event").Info("handling event")
 		err = fh.HandleStatusEvent(body)
+	case "group_change_success":
+		log.WithField("eventType", eventType).Info("handling event")
+		err = fh.HandleGroupChangeEvent(body)
+	case "pod_created_event", "pod_updated_event", "pod_deleted_event":
+		log.WithField("eventType", eventType).Info("handling event")
+		err = fh.HandlePodEvent(body)
+	case "instance_changed_event":
+		log.WithField("eventType", eventType).Info("handling event")
+		err = fh.HandleInstanceChangedEvent(body)
 	default:
 		log.WithField("eventType", eventType).Info("not handling event")
 		w.WriteHeader(200)
@@ -71,6 +156,11 @@ func (fh *ForwardHandler) HandleAppEvent(body []byte) error {
 	}
 
 	for _, app := range event.Apps() {
+		_, problems := app.Service()
+		for _, problem := range problems {
+			log.WithField("app", app.ID).WithError(problem).Warn("ignoring bad label")
+		}
+
 		err = fh.consul.UpdateApp(app)
 		if err != nil {
 			return err
@@ -91,25 +181,102 @@ func (fh *ForwardHandler) HandleTerminationEvent(body []byte) error {
 }
 
 func (fh *ForwardHandler) HandleStatusEvent(body []byte) error {
-	// for every other use of Tasks, Marathon uses the "id" field for the task ID.
-	// Here, it uses "taskId", with most of the other fields being equal. We'll
-	// just swap "taskId" for "id" in the body so that we can successfully parse
-	// incoming events.
-	body = bytes.Replace(body, []byte("taskId"), []byte("id"), -1)
+	event, err := events.ParseStatusUpdateEvent(body)
+	if err != nil {
+		return err
+	}
+	task := event.Task()
+	fh.apps.add(task.AppID)
 
-	task, err := tasks.ParseTask(body)
+	action, err := fh.taskPolicy().Action(task.TaskStatus)
+	if err != nil {
+		return err
+	}
 
+	switch action {
+	case tasks.Remove:
+		return fh.consul.DeleteTask(task)
+	case tasks.Mark:
+		task.Mark(time.Now())
+	}
+	return fh.consul.UpdateTask(task)
+}
+
+func (fh *ForwardHandler) taskPolicy() tasks.Policy {
+	if fh.policy == nil {
+		return tasks.DefaultPolicy()
+	}
+	return *fh.policy
+}
+
+func (fh *ForwardHandler) HandleDeploymentEvent(body []byte) error {
+	event, err := events.ParseDeploymentEvent(body)
 	if err != nil {
 		return err
 	}
 
-	switch task.TaskStatus {
-	case "TASK_FINISHED", "TASK_FAILED", "TASK_KILLED", "TASK_LOST":
-		err = fh.consul.DeleteTask(task)
-	case "TASK_STAGING", "TASK_STARTING", "TASK_RUNNING":
-		err = fh.consul.UpdateTask(task)
-	default:
-		err = errors.New("unknown task status")
+	deployment := event.Deployment()
+	if event.Finished() {
+		return fh.consul.DeleteDeployment(deployment)
+	}
+	return fh.consul.UpdateDeployment(deployment)
+}
+
+// HandleGroupChangeEvent replaces every group, since a change to one group
+// may add or remove any number of groups below it
+func (fh *ForwardHandler) HandleGroupChangeEvent(body []byte) error {
+	groupList, err := fh.marathon.Groups()
+	if err != nil {
+		return err
+	}
+
+	return fh.consul.SyncGroups(groupList)
+}
+
+func (fh *ForwardHandler) HandlePodEvent(body []byte) error {
+	event, err := events.ParsePodEvent(body)
+	if err != nil {
+		return err
+	}
+
+	if event.Type == "pod_deleted_event" {
+		return fh.consul.DeletePod(&pods.Pod{ID: event.PodID()})
+	}
+	fh.apps.forget(event.PodID())
+
+	status, err := fh.marathon.PodStatus(event.PodID())
+	if err != nil {
+		return err
+	}
+
+	err = fh.consul.UpdatePod(status.Spec)
+	if err != nil {
+		return err
 	}
-	return err
+	return fh.consul.SyncPodInstances(status.ID, status.Instances)
+}
+
+func (fh *ForwardHandler) HandleInstanceChangedEvent(body []byte) error {
+	event, err := events.ParseInstanceChangedEvent(body)
+	if err != nil {
+		return err
+	}
+
+	// the event doesn't say whether the instance belongs to an app or a pod,
+	// nor which ports it was given, so look the pod up unless it's a known
+	// app. App instances are handled through status_update_event instead.
+	if fh.apps.has(event.RunSpecID) {
+		return nil
+	}
+	status, err := fh.marathon.PodStatus(event.RunSpecID)
+	if err == marathon.ErrNotFound {
+		log.WithField("runSpecId", event.RunSpecID).Debug("instance does not belong to a pod")
+		fh.apps.add(event.RunSpecID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return fh.consul.SyncPodInstances(status.ID, status.Instances)
 }
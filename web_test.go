@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 
 	"github.com/CiscoCloud/marathon-consul/apps"
 	"github.com/CiscoCloud/marathon-consul/consul"
 	"github.com/CiscoCloud/marathon-consul/events"
+	"github.com/CiscoCloud/marathon-consul/marathon"
 	"github.com/CiscoCloud/marathon-consul/mocks"
+	"github.com/CiscoCloud/marathon-consul/pods"
 	"github.com/CiscoCloud/marathon-consul/tasks"
 	"github.com/stretchr/testify/assert"
 )
@@ -51,7 +52,7 @@ func TestForwardHandlerHandleAppEvent(t *testing.T) {
 	// create a handler
 	kv := mocks.NewKVer()
 	consul := consul.NewConsul(kv, "")
-	handler := ForwardHandler{consul}
+	handler := ForwardHandler{consul: &consul}
 
 	body, err := json.Marshal(events.APIPostEvent{"api_post_event", testApp})
 	assert.Nil(t, err)
@@ -71,7 +72,7 @@ func TestForwardHandlerHandleTerminationEvent(t *testing.T) {
 	// create a handler
 	kv := mocks.NewKVer()
 	consul := consul.NewConsul(kv, "")
-	handler := ForwardHandler{consul}
+	handler := ForwardHandler{consul: &consul}
 
 	err := consul.UpdateApp(testApp)
 	assert.Nil(t, err)
@@ -92,13 +93,18 @@ func TestForwardHandlerHandleTerminationEvent(t *testing.T) {
 }
 
 func tempTaskBody(status string) []byte {
-	body, _ := json.Marshal(testTask)
-	return []byte(strings.Replace(
-		string(body),
-		testTask.TaskStatus,
-		status,
-		1,
-	))
+	body, _ := json.Marshal(events.StatusUpdateEvent{
+		Type:       "status_update_event",
+		Timestamp:  testTask.Timestamp,
+		SlaveID:    testTask.SlaveID,
+		TaskID:     testTask.ID,
+		TaskStatus: status,
+		AppID:      testTask.AppID,
+		Host:       testTask.Host,
+		Ports:      testTask.Ports,
+		Version:    testTask.Version,
+	})
+	return body
 }
 
 func TestForwardHandlerHandleStatusEvent(t *testing.T) {
@@ -107,7 +113,7 @@ func TestForwardHandlerHandleStatusEvent(t *testing.T) {
 	// create a handler
 	kv := mocks.NewKVer()
 	consul := consul.NewConsul(kv, "")
-	handler := ForwardHandler{consul}
+	handler := ForwardHandler{consul: &consul}
 
 	// deletes
 	for _, status := range []string{"TASK_FINISHED", "TASK_FAILED", "TASK_KILLED", "TASK_LOST"} {
@@ -129,7 +135,8 @@ func TestForwardHandlerHandleStatusEvent(t *testing.T) {
 	// puts
 	for _, status := range []string{"TASK_STAGING", "TASK_STARTING", "TASK_RUNNING"} {
 		tempBody := tempTaskBody(status)
-		tempTask, _ := tasks.ParseTask(tempBody)
+		tempEvent, _ := events.ParseStatusUpdateEvent(tempBody)
+		tempTask := tempEvent.Task()
 
 		// test
 		err := handler.HandleStatusEvent(tempBody)
@@ -151,3 +158,193 @@ func TestForwardHandlerHandleStatusEvent(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, err.Error(), "unknown task status")
 }
+
+func TestForwardHandlerHandlePodEvent(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	pod := &pods.Pod{ID: "/test-pod"}
+	instance := &pods.Instance{ID: "test-pod.instance-1", PodID: pod.ID}
+	handler := ForwardHandler{consul: &consul, marathon: mocks.Marathoner{
+		PodList: []*pods.Status{{ID: pod.ID, Spec: pod, Instances: []*pods.Instance{instance}}},
+	}}
+
+	// test!
+	err := handler.HandlePodEvent([]byte(`{"eventType": "pod_created_event", "uri": "/v2/pods/test-pod"}`))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get(pod.Key())
+	assert.Nil(t, err)
+	assert.Equal(t, pod.KV(), result)
+
+	result, _, err = kv.Get(instance.Key())
+	assert.Nil(t, err)
+	assert.Equal(t, instance.KV(), result)
+
+	// deleting the pod deletes its instances too
+	err = handler.HandlePodEvent([]byte(`{"eventType": "pod_deleted_event", "uri": "/v2/pods/test-pod"}`))
+	assert.Nil(t, err)
+
+	remaining, _, err := kv.List("_pods")
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 0)
+}
+
+func TestForwardHandlerHandleInstanceChangedEvent(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	instance := &pods.Instance{ID: "test-pod.instance-1", PodID: "/test-pod"}
+	handler := ForwardHandler{consul: &consul, marathon: mocks.Marathoner{
+		PodList:  []*pods.Status{{ID: "/test-pod", Instances: []*pods.Instance{instance}}},
+		NotFound: marathon.ErrNotFound,
+	}}
+
+	// test!
+	err := handler.HandleInstanceChangedEvent([]byte(`{"eventType": "instance_changed_event", "runSpecId": "/test-pod", "condition": "Running"}`))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get(instance.Key())
+	assert.Nil(t, err)
+	assert.Equal(t, instance.KV(), result)
+
+	// app instances are not our business here
+	err = handler.HandleInstanceChangedEvent([]byte(`{"eventType": "instance_changed_event", "runSpecId": "/my-app", "condition": "Running"}`))
+	assert.Nil(t, err)
+}
+
+// countingMarathoner counts pod lookups
+type countingMarathoner struct {
+	mocks.Marathoner
+	lookups *int
+}
+
+func (m countingMarathoner) PodStatus(pod string) (*pods.Status, error) {
+	*m.lookups++
+	return m.Marathoner.PodStatus(pod)
+}
+
+func TestForwardHandlerSkipsAppInstances(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	lookups := 0
+	handler := ForwardHandler{consul: &consul, marathon: countingMarathoner{
+		mocks.Marathoner{NotFound: marathon.ErrNotFound}, &lookups,
+	}}
+	changed := []byte(`{"eventType": "instance_changed_event", "runSpecId": "/my-app", "condition": "Running"}`)
+
+	// test!
+	assert.Nil(t, handler.HandleStatusEvent(tempTaskBody("TASK_RUNNING")))
+	assert.Nil(t, handler.HandleInstanceChangedEvent(changed))
+	assert.Equal(t, 0, lookups)
+
+	// an app only known from a failed lookup is only looked up once
+	other := []byte(`{"eventType": "instance_changed_event", "runSpecId": "/other-app", "condition": "Running"}`)
+	assert.Nil(t, handler.HandleInstanceChangedEvent(other))
+	assert.Nil(t, handler.HandleInstanceChangedEvent(other))
+	assert.Equal(t, 1, lookups)
+}
+
+func TestForwardHandlerHandleDeploymentEvent(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	handler := ForwardHandler{consul: &consul}
+
+	// test!
+	err := handler.HandleDeploymentEvent([]byte(`{
+		"eventType": "deployment_info",
+		"plan": {"id": "abc", "steps": [{"actions": [{"action": "ScaleApplication", "app": "/my-app"}]}]},
+		"currentStep": {"actions": [{"action": "ScaleApplication", "app": "/my-app"}]}
+	}`))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get("_deployments/abc")
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+
+	// finished deployments are removed
+	err = handler.HandleDeploymentEvent([]byte(`{"eventType": "deployment_success", "id": "abc"}`))
+	assert.Nil(t, err)
+
+	result, _, err = kv.Get("_deployments/abc")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
+
+func TestForwardHandlerHandleStatusEventMerges(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	handler := ForwardHandler{consul: &consul}
+
+	// what we learned from /v2/apps/<id>/tasks
+	stored := *testTask
+	stored.TaskStatus = "TASK_STARTING"
+	stored.StartedAt = "2014-03-01T23:29:29.158Z"
+	stored.HealthCheckResults = []tasks.HealthCheckResult{{Alive: true, TaskID: testTask.ID}}
+	err := consul.UpdateTask(&stored)
+	assert.Nil(t, err)
+
+	// test!
+	err = handler.HandleStatusEvent(tempTaskBody("TASK_RUNNING"))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get(testTask.Key())
+	assert.Nil(t, err)
+	updated, err := tasks.ParseTask(result.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "TASK_RUNNING", updated.TaskStatus)
+	assert.Equal(t, stored.StartedAt, updated.StartedAt)
+	assert.Equal(t, stored.HealthCheckResults, updated.HealthCheckResults)
+}
+
+func TestForwardHandlerHandleStatusEventPolicy(t *testing.T) {
+	t.Parallel()
+
+	// create a handler
+	kv := mocks.NewKVer()
+	consul := consul.NewConsul(kv, "")
+	policy := tasks.DefaultPolicy()
+	policy.Actions[tasks.Killing] = tasks.Remove
+	handler := ForwardHandler{consul: &consul, policy: &policy}
+
+	// unreachable tasks are kept, but marked
+	err := handler.HandleStatusEvent(tempTaskBody(tasks.Unreachable))
+	assert.Nil(t, err)
+
+	result, _, err := kv.Get(testTask.Key())
+	assert.Nil(t, err)
+	marked, err := tasks.ParseTask(result.Value)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", marked.MarkedAt)
+
+	// coming back clears the mark
+	err = handler.HandleStatusEvent(tempTaskBody(tasks.Running))
+	assert.Nil(t, err)
+
+	result, _, err = kv.Get(testTask.Key())
+	assert.Nil(t, err)
+	running, err := tasks.ParseTask(result.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "", running.MarkedAt)
+
+	// the policy is configurable
+	err = handler.HandleStatusEvent(tempTaskBody(tasks.Killing))
+	assert.Nil(t, err)
+
+	result, _, err = kv.Get(testTask.Key())
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}